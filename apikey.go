@@ -0,0 +1,167 @@
+package citra
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/previnder/citra/pkg/luid"
+)
+
+// APIKeyPrefix is prepended to all API keys to make them easy to recognize.
+const APIKeyPrefix = "citra_"
+
+// Scope is a permission granted to an API key.
+type Scope string
+
+// Valid scopes.
+const (
+	ScopeUpload       = Scope("upload")
+	ScopeReadMetadata = Scope("read-metadata")
+	ScopeDelete       = Scope("delete")
+)
+
+// Errors.
+var (
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	ErrInvalidScope  = errors.New("invalid scope")
+)
+
+// ParseScopes parses a comma separated list of scopes.
+func ParseScopes(s string) ([]Scope, error) {
+	var scopes []Scope
+	for _, item := range strings.Split(s, ",") {
+		scope := Scope(strings.TrimSpace(item))
+		switch scope {
+		case ScopeUpload, ScopeReadMetadata, ScopeDelete:
+			scopes = append(scopes, scope)
+		case "":
+		default:
+			return nil, ErrInvalidScope
+		}
+	}
+	return scopes, nil
+}
+
+// APIKey is a record in the api_keys table. The key itself is not stored, only
+// its hash.
+type APIKey struct {
+	ID        luid.ID    `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []Scope    `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// HasScope reports whether k is granted scope.
+func (k *APIKey) HasScope(scope Scope) bool {
+	for _, item := range k.Scopes {
+		if item == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashAPIKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+func joinScopes(scopes []Scope) string {
+	s := make([]string, len(scopes))
+	for i, item := range scopes {
+		s[i] = string(item)
+	}
+	return strings.Join(s, ",")
+}
+
+// CreateAPIKey creates an API key with scopes and returns it along with the
+// key. The key cannot be retrieved later.
+func CreateAPIKey(db *sql.DB, name string, scopes []Scope) (*APIKey, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	key := APIKeyPrefix + hex.EncodeToString(b)
+
+	ID, now := luid.New()
+	_, err := db.Exec("insert into api_keys (id, name, key_hash, scopes, created_at) values (?, ?, ?, ?, ?)",
+		ID, name, hashAPIKey(key), joinScopes(scopes), now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &APIKey{ID: ID, Name: name, Scopes: scopes, CreatedAt: now}, key, nil
+}
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	k := &APIKey{}
+	var scopes string
+	if err := row.Scan(&k.ID, &k.Name, &scopes, &k.CreatedAt, &k.RevokedAt); err != nil {
+		return nil, err
+	}
+	var err error
+	if k.Scopes, err = ParseScopes(scopes); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// GetAPIKeys returns all API keys, including revoked ones.
+func GetAPIKeys(db *sql.DB) ([]*APIKey, error) {
+	rows, err := db.Query("select id, name, scopes, created_at, revoked_at from api_keys order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes the API key with ID. It returns sql.ErrNoRows if no such
+// key exists or if it's already revoked.
+func RevokeAPIKey(db *sql.DB, ID luid.ID) error {
+	res, err := db.Exec("update api_keys set revoked_at = ? where id = ? and revoked_at is null", time.Now(), ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// AuthenticateAPIKey returns the API key key. It returns ErrInvalidAPIKey if no
+// such key exists or if it's revoked.
+func AuthenticateAPIKey(db *sql.DB, key string) (*APIKey, error) {
+	row := db.QueryRow("select id, name, scopes, created_at, revoked_at from api_keys where key_hash = ?", hashAPIKey(key))
+	k, err := scanAPIKey(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+	if k.RevokedAt != nil {
+		return nil, ErrInvalidAPIKey
+	}
+	return k, nil
+}
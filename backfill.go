@@ -0,0 +1,87 @@
+package citra
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	"github.com/previnder/citra/pkg/luid"
+)
+
+// backfillBatchSize is the number of images fetched from DB at a time while
+// backfilling.
+const backfillBatchSize = 100
+
+// BackfillImages computes the fields derived from the default image (for
+// example the perceptual hash, BlurHash, and palette) of all non-deleted images
+// that were saved before those fields existed. The average color of those
+// images is recomputed as well. It returns the number of images updated and
+// the number of images that could not be updated. Errors with individual
+// images are logged and skipped.
+func BackfillImages(db *sql.DB, store Storage) (updated, failed int, err error) {
+	var cursor luid.ID
+	for {
+		rows, err := db.Query(`select id from images where (phash is null or blurhash is null or palette is null) and is_deleted = false
+			and id > ? order by id limit ?`, cursor, backfillBatchSize)
+		if err != nil {
+			return updated, failed, err
+		}
+
+		var IDs []luid.ID
+		for rows.Next() {
+			var ID luid.ID
+			if err = rows.Scan(&ID); err != nil {
+				rows.Close()
+				return updated, failed, err
+			}
+			IDs = append(IDs, ID)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return updated, failed, err
+		}
+
+		if len(IDs) == 0 {
+			return updated, failed, nil
+		}
+
+		for _, ID := range IDs {
+			if err = backfillImage(db, store, ID); err != nil {
+				log.Println("Error backfilling image", ID, ":", err)
+				failed++
+				continue
+			}
+			updated++
+		}
+		cursor = IDs[len(IDs)-1]
+	}
+}
+
+func backfillImage(db *sql.DB, store Storage, ID luid.ID) error {
+	image, err := GetImage(db, ID)
+	if err != nil {
+		return err
+	}
+
+	buf, err := ReadFile(store, imageFilePath(image.Folder, ID.String()+image.Type.Extension()))
+	if err != nil {
+		return err
+	}
+
+	decoded, err := decodeForAnalysis(buf)
+	if err != nil {
+		return err
+	}
+
+	blurHash, err := BlurHash(decoded)
+	if err != nil {
+		return err
+	}
+
+	color, _ := json.Marshal(AverageColor(decoded))
+	palette, _ := json.Marshal(Palette(decoded, PaletteSize))
+
+	_, err = db.Exec("update images set average_color = ?, palette = ?, phash = ?, blurhash = ? where id = ?",
+		color, palette, int64(DHash(decoded)), blurHash, ID)
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/previnder/citra"
+)
+
+// runFsckCommand runs the fsck subcommand, which checks that the files in
+// storage match the folders and images tables.
+//
+// Repairs must be made with the server stopped: folder counts of images being
+// saved would be reset, and their files could be taken for orphans. Repairing
+// is refused while a server holds its lock on the DB.
+func runFsckCommand(db *sql.DB, store citra.Storage, args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "Delete orphan files, regenerate missing copies, and fix folder counts (stop the server first)")
+	grace := fs.Duration("grace", time.Hour, "Files modified more recently than this are not taken for orphans")
+	fs.Parse(args)
+
+	problems, err := citra.Fsck(db, store, *repair, *grace)
+	if err == citra.ErrServerRunning {
+		log.Fatal("A server is running on the DB; stop it before running fsck -repair")
+	}
+	for _, p := range problems {
+		line := fmt.Sprintf("%v\tfolder %v (%v)", p.Kind, p.FolderID, p.Folder)
+		if p.Name != "" {
+			line += "\t" + p.Name
+		}
+		if p.Detail != "" {
+			line += "\t" + p.Detail
+		}
+		if p.Repaired {
+			line += "\t(repaired)"
+		} else if p.RepairError != nil {
+			line += "\t(repair failed: " + p.RepairError.Error() + ")"
+		}
+		fmt.Println(line)
+	}
+	if err != nil {
+		log.Fatal("Error checking storage: ", err)
+	}
+
+	log.Println("Found", len(problems), "problems")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/previnder/citra"
+	"github.com/previnder/citra/pkg/luid"
+)
+
+const keysUsage = `Usage:
+  citra keys create -name NAME [-scopes upload,read-metadata,delete]
+  citra keys list
+  citra keys revoke ID`
+
+// runKeysCommand runs the keys subcommand, which manages API keys.
+func runKeysCommand(db *sql.DB, args []string) {
+	if len(args) == 0 {
+		log.Fatal(keysUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("keys create", flag.ExitOnError)
+		name := fs.String("name", "", "Name of the key")
+		scopesList := fs.String("scopes", "upload,read-metadata,delete", "Comma separated list of scopes")
+		fs.Parse(args[1:])
+
+		if *name == "" {
+			log.Fatal("Key name is required")
+		}
+		scopes, err := citra.ParseScopes(*scopesList)
+		if err != nil {
+			log.Fatal("Error parsing scopes: ", err)
+		}
+
+		key, secret, err := citra.CreateAPIKey(db, *name, scopes)
+		if err != nil {
+			log.Fatal("Error creating API key: ", err)
+		}
+		fmt.Println("Created API key", key.ID, "(store it now, it cannot be shown again):")
+		fmt.Println(secret)
+	case "list":
+		keys, err := citra.GetAPIKeys(db)
+		if err != nil {
+			log.Fatal("Error listing API keys: ", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tCREATED\tREVOKED")
+		for _, key := range keys {
+			scopes := make([]string, len(key.Scopes))
+			for i, scope := range key.Scopes {
+				scopes[i] = string(scope)
+			}
+			revoked := "-"
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", key.ID, key.Name, strings.Join(scopes, ","),
+				key.CreatedAt.Format("2006-01-02 15:04"), revoked)
+		}
+		tw.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			log.Fatal(keysUsage)
+		}
+		ID, err := luid.FromString(args[1])
+		if err != nil {
+			log.Fatal("Invalid key ID: ", err)
+		}
+		if err = citra.RevokeAPIKey(db, ID); err != nil {
+			if err == sql.ErrNoRows {
+				log.Fatal("No such active key: ", args[1])
+			}
+			log.Fatal("Error revoking API key: ", err)
+		}
+		fmt.Println("Revoked API key", ID)
+	default:
+		log.Fatal(keysUsage)
+	}
+}
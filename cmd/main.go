@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"log"
@@ -55,7 +56,7 @@ func main() {
 		config.RootUploadsDir = *uploadsDir
 	}
 
-	if config.DeletedDir != "" {
+	if config.Storage.Type != citra.StorageTypeS3 && config.DeletedDir != "" {
 		info, err := os.Stat(config.DeletedDir)
 		if err == nil {
 			if !info.IsDir() {
@@ -74,6 +75,11 @@ func main() {
 
 	db := openDB(config.Database.User, config.Database.Password, config.Database.Database)
 
+	store, deletedStore, err := citra.NewStorage(config)
+	if err != nil {
+		log.Fatal("Error opening storage: ", err)
+	}
+
 	if *runMigrations {
 		log.Println("Running migrations...")
 		if err := citra.RunMigrations(db); err != nil {
@@ -82,8 +88,54 @@ func main() {
 		log.Println("Migrations completed")
 	}
 
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+	case "keys":
+		runKeysCommand(db, flag.Args()[1:])
+		return
+	case "fsck":
+		runFsckCommand(db, store, flag.Args()[1:])
+		return
+	case "purge":
+		if config.DeletedRetentionDays <= 0 {
+			log.Fatal("deletedRetentionDays is not set in config")
+		}
+		t := time.Now().AddDate(0, 0, -config.DeletedRetentionDays)
+		log.Println("Purging images deleted before", t.Format(time.RFC3339))
+		n, err := citra.PurgeDeletedImages(db, deletedStore, t)
+		if err != nil {
+			log.Fatal("Error purging deleted images: ", err)
+		}
+		log.Println("Purged", n, "images")
+		return
+	case "move-images":
+		log.Println("Moving images to", config.Folders.Strategy, "folders...")
+		moved, failed, err := citra.MoveImages(db, store, config.Folders)
+		if err != nil {
+			log.Fatal("Error moving images: ", err)
+		}
+		log.Printf("Move completed (%v images moved, %v failed)\n", moved, failed)
+		return
+	case "regenerate":
+		runRegenerateCommand(db, store, flag.Args()[1:])
+		return
+	case "backfill":
+		log.Println("Backfilling images...")
+		updated, failed, err := citra.BackfillImages(db, store)
+		if err != nil {
+			log.Fatal("Error backfilling images: ", err)
+		}
+		log.Printf("Backfill completed (%v images updated, %v failed)\n", updated, failed)
+		return
+	default:
+		log.Fatal("Unknown command: ", cmd)
+	}
+
 	if *runServer {
-		server := citra.NewServer(db, config)
+		server := citra.NewServer(db, config, store, deletedStore)
+		if err := server.Start(context.Background()); err != nil {
+			log.Fatal("Error starting server: ", err)
+		}
 		log.Println("Starting HTTP server on", config.Addr)
 		log.Fatal(http.ListenAndServe(config.Addr, server))
 	}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"log"
+	"runtime"
+	"time"
+
+	"github.com/previnder/citra"
+	"github.com/previnder/citra/pkg/luid"
+)
+
+// runRegenerateCommand runs the regenerate subcommand, which recreates copies
+// of images from their default images. Default images are never recreated;
+// see citra.RegenerateCopies.
+func runRegenerateCommand(db *sql.DB, store citra.Storage, args []string) {
+	fs := flag.NewFlagSet("regenerate", flag.ExitOnError)
+	after := fs.String("after", "", "Resume after the image with this ID (the cursor of the last progress report)")
+	minFolder := fs.Int("min-folder", 0, "Only images in folders with IDs at least this")
+	maxFolder := fs.Int("max-folder", 0, "Only images in folders with IDs at most this")
+	createdAfter := fs.String("created-after", "", "Only images created on or after this date (YYYY-MM-DD or RFC 3339)")
+	createdBefore := fs.String("created-before", "", "Only images created before this date (YYYY-MM-DD or RFC 3339)")
+	size := fs.String("size", "", "Only copies of this size (for example 400 or 400x300)")
+	fit := fs.String("fit", "", "Only copies of this fit (cover or contain)")
+	imageType := fs.String("type", "", "Only copies of this type (jpeg, webp, or avif)")
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of images processed concurrently")
+	dryRun := fs.Bool("dry-run", false, "Only count the copies that would be regenerated")
+	fs.Parse(args)
+
+	arg := citra.RegenerateArg{
+		MinFolderID: *minFolder,
+		MaxFolderID: *maxFolder,
+		Workers:     *workers,
+		DryRun:      *dryRun,
+	}
+	var err error
+	if *after != "" {
+		if arg.After, err = luid.FromString(*after); err != nil {
+			log.Fatal("Invalid -after: ", err)
+		}
+	}
+	if arg.CreatedAfter, err = parseDate(*createdAfter); err != nil {
+		log.Fatal("Invalid -created-after: ", err)
+	}
+	if arg.CreatedBefore, err = parseDate(*createdBefore); err != nil {
+		log.Fatal("Invalid -created-before: ", err)
+	}
+	if *size != "" {
+		if err = arg.Size.UnmarshalText([]byte(*size)); err != nil {
+			log.Fatal("Invalid -size: ", err)
+		}
+	}
+	if *fit != "" {
+		if err = arg.Fit.UnmarshalText([]byte(*fit)); err != nil {
+			log.Fatal("Invalid -fit: ", err)
+		}
+	}
+	if *imageType != "" {
+		if err = arg.Type.UnmarshalText([]byte(*imageType)); err != nil {
+			log.Fatal("Invalid -type: ", err)
+		}
+	}
+
+	start := time.Now()
+	arg.Progress = func(p citra.RegenerateProgress) {
+		log.Printf("%v images (%v copies, %v failed) in %v, cursor %v\n",
+			p.Images, p.Copies, p.Failed, time.Since(start).Round(time.Second), p.Cursor)
+	}
+
+	if arg.DryRun {
+		log.Println("Counting copies to regenerate (dry run)...")
+	} else {
+		log.Println("Regenerating copies...")
+	}
+	p, err := citra.RegenerateCopies(db, store, arg)
+	if err != nil {
+		log.Fatal("Error regenerating copies (resume with -after ", p.Cursor, "): ", err)
+	}
+	log.Printf("Regenerate completed (%v images, %v copies, %v failed)\n", p.Images, p.Copies, p.Failed)
+}
+
+// parseDate parses s as either a date or an RFC 3339 time. An empty s is the
+// zero time.
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
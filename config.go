@@ -2,6 +2,7 @@ package citra
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"os"
 )
@@ -18,6 +19,29 @@ type Config struct {
 	// Address to listen on.
 	Addr string `json:"addr"`
 
+	// Where images are stored. By default they are stored on disk, in
+	// RootUploadsDir and DeletedDir.
+	Storage struct {
+		// Either "disk" (default) or "s3".
+		Type string `json:"type"`
+
+		// S3 compatible bucket, used if Type is "s3".
+		S3 struct {
+			Endpoint  string `json:"endpoint"`
+			Region    string `json:"region"`
+			Bucket    string `json:"bucket"`
+			AccessKey string `json:"accessKey"`
+			SecretKey string `json:"secretKey"`
+
+			// Prepended to the keys of all images.
+			Prefix string `json:"prefix"`
+
+			// Deleted images are moved to keys with this prefix. If empty, the
+			// images are deleted.
+			DeletedPrefix string `json:"deletedPrefix"`
+		} `json:"s3"`
+	} `json:"storage"`
+
 	// All images are saved inside subfolders in this directory.
 	RootUploadsDir string `json:"rootUploadsDir"`
 
@@ -25,8 +49,72 @@ type Config struct {
 	// deleted.
 	DeletedDir string `json:"deletedDir"`
 
+	// Deleted images are purged (their files are permanently removed) this many
+	// days after they are deleted. If 0, deleted images are never purged.
+	DeletedRetentionDays int `json:"deletedRetentionDays"`
+
+	// If true, the HTTP server purges expired deleted images every hour.
+	// Otherwise they are only purged by the purge command.
+	PurgeInBackground bool `json:"purgeInBackground"`
+
+	// How images are distributed among folders. See FolderLayout. Changing
+	// the layout only affects new images; run the move-images command to move
+	// existing ones.
+	Folders FolderLayout `json:"folders"`
+
 	// Requests with images larger than this would be discarded.
 	MaxUploadSize int `json:"maxUploadSize"`
+
+	// Partial uploads, made with the tus resumable upload protocol at
+	// /api/uploads, are kept in the DB and in Storage, under tus/, until they
+	// are complete, so that they can be resumed on any server.
+	//
+	// Partial uploads that receive no data for this many hours are removed. If
+	// 0, partial uploads never expire.
+	PartialUploadExpiryHours int `json:"partialUploadExpiryHours"`
+
+	// Uploads are streamed to temporary files in this directory while they are
+	// processed. If empty, the default directory for temporary files.
+	TempDir string `json:"tempDir"`
+
+	// Maximum number of requests that process images (uploads, restores,
+	// copies made on demand) and upload jobs run at once. If 0, the number of
+	// CPUs.
+	MaxConcurrentProcessing int `json:"maxConcurrentProcessing"`
+
+	// Maximum number of requests waiting for processing. Requests beyond that
+	// are rejected with 503 Service Unavailable before any of their images is
+	// processed. If 0, 4 times MaxConcurrentProcessing.
+	ProcessingQueueDepth int `json:"processingQueueDepth"`
+
+	// Copies of these sizes (of any fit and type) that were not made when an
+	// image was uploaded are generated from the default image the first time
+	// they are requested. Sizes are of the form "400" or "400x600". If empty,
+	// no copies are generated on demand.
+	OnDemandSizes []ImageSize `json:"onDemandSizes"`
+
+	// Named sets of copies that images can be uploaded with, instead of
+	// listing the copies in each upload. Each preset must have a default copy.
+	// The name of a preset can also be used in image URLs, as ?preset=name, in
+	// place of the size, fit, and type of its default copy. For images
+	// uploaded with the preset, the default image is served. Otherwise the URL
+	// is that of a copy: it must be signed if URLSecret is set, and the copy
+	// is only generated on demand if its size is in OnDemandSizes.
+	Presets map[string][]SaveImageArg `json:"presets"`
+
+	// If non-empty, URLs of copies of images (URLs with a size or preset query
+	// parameter) must be signed with this secret. See package urlsign.
+	URLSecret string `json:"urlSecret"`
+}
+
+// presetDefault returns the default copy of preset name.
+func (c *Config) presetDefault(name string) (SaveImageArg, bool) {
+	for _, item := range c.Presets[name] {
+		if item.IsDefault {
+			return item, true
+		}
+	}
+	return SaveImageArg{}, false
 }
 
 // UnmarshalConfigFile reads the config in file and returns it. In case no such
@@ -37,6 +125,7 @@ func UnmarshalConfigFile(file string) (*Config, error) {
 	config.RootUploadsDir = "./uploads"
 	config.DeletedDir = "./deleted"
 	config.MaxUploadSize = 10 << 20
+	config.PartialUploadExpiryHours = 24
 
 	f, err := os.Open(file)
 	if err != nil {
@@ -56,5 +145,15 @@ func UnmarshalConfigFile(file string) (*Config, error) {
 		return nil, err
 	}
 
+	if err = config.Folders.Validate(); err != nil {
+		return nil, err
+	}
+
+	for name := range config.Presets {
+		if _, ok := config.presetDefault(name); !ok {
+			return nil, errors.New("preset " + name + ": " + ErrNoDefaultImage.Error())
+		}
+	}
+
 	return config, nil
 }
@@ -1,15 +1,13 @@
 package citra
 
 import (
-	"bytes"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"image/jpeg"
-	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,17 +15,28 @@ import (
 	"github.com/golang-migrate/migrate"
 	"github.com/golang-migrate/migrate/database/mysql"
 	"github.com/previnder/citra/pkg/luid"
+	"github.com/previnder/citra/pkg/urlsign"
 )
 
 const (
-	// MaxImagesPerFolder sets the maximum number of image files (without
-	// counting copies) that can be saved in one folder.
+	// MaxImagesPerFolder is the default maximum number of image files (without
+	// counting copies) that can be saved in one folder, if folders are
+	// allocated by count. See FolderLayout.
 	MaxImagesPerFolder = 4000
+
+	// FirstFolderID is the id of the first folder created.
+	FirstFolderID = 1000
+
+	// PaletteSize is the maximum number of colors in the palette of an image.
+	PaletteSize = 5
 )
 
 // Errors.
 var (
 	ErrNoDefaultImage = errors.New("no default image was provided")
+	ErrImageDeleted   = errors.New("image is deleted")
+	ErrImagePurged    = errors.New("deleted image file no longer exists")
+	ErrCopyNotFound   = errors.New("image has no such copy")
 )
 
 // RunMigrations runs all the migrations in migrations folder.
@@ -57,13 +66,45 @@ type ImageCopy struct {
 	MaxWidth  int      `json:"mw"`
 	MaxHeight int      `json:"mh"`
 	ImageFit  ImageFit `json:"if"`
+	// Type is empty for copies saved before image types other than JPEG were
+	// supported.
+	Type ImageType `json:"t,omitempty"`
 	// Size of image in bytes.
 	Size int `json:"s"`
+
+	// If true, the copy is a variant: the default image saved in another
+	// type, which is served in place of it to clients that prefer that type.
+	// Variants are named as the default image but for their extension.
+	Variant bool `json:"v,omitempty"`
 }
 
 // Filename returns the basename of the image stored on disk.
 func (c ImageCopy) Filename(imageID string) string {
-	return imageID + "_" + strconv.Itoa(c.MaxWidth) + "_" + strconv.Itoa(c.MaxHeight) + "_" + strings.ToLower(string(c.ImageFit)) + ".jpg"
+	if c.Variant {
+		return imageID + c.Type.Extension()
+	}
+	return imageID + "_" + strconv.Itoa(c.MaxWidth) + "_" + strconv.Itoa(c.MaxHeight) + "_" + strings.ToLower(string(c.ImageFit)) + c.Type.Extension()
+}
+
+// isCopyOf reports whether c is the copy of an image described by arg.
+// Variants are not.
+func (c ImageCopy) isCopyOf(arg SaveImageArg) bool {
+	return !c.Variant && c.MaxWidth == arg.MaxWidth && c.MaxHeight == arg.MaxHeight &&
+		c.ImageFit == arg.ImageFit && c.Type.Extension() == arg.Type.Extension()
+}
+
+// isVariantOf reports whether c is the variant of an image of type t.
+func (c ImageCopy) isVariantOf(t ImageType) bool {
+	return c.Variant && c.Type.Extension() == t.Extension()
+}
+
+// saveImageArg returns the argument to SaveImage that c was created with.
+func (c ImageCopy) saveImageArg() SaveImageArg {
+	arg := SaveImageArg{MaxWidth: c.MaxWidth, MaxHeight: c.MaxHeight, ImageFit: c.ImageFit, Type: c.Type}
+	if arg.Type == "" {
+		arg.Type = ImageTypeJPEG
+	}
+	return arg
 }
 
 // DBImage is a record in the images table.
@@ -72,7 +113,10 @@ type DBImage struct {
 
 	FolderID int `json:"folderId"`
 
-	// Always JPEG for now.
+	// Path of the folder in storage. See FolderLayout.
+	Folder string `json:"folder"`
+
+	// Type of the default image. Copies may be of a different type.
 	Type ImageType `json:"type"`
 
 	// Actual width of image.
@@ -93,33 +137,90 @@ type DBImage struct {
 	// Size of original uploaded image in bytes.
 	UploadedSize int `json:"-"`
 
+	// Number of uploads of this image. Identical uploads (with identical
+	// arguments) are deduplicated into one image, which is only deleted once
+	// all of them are.
+	RefCount int `json:"refCount"`
+
+	// True if this image was returned by SaveImage in place of saving an
+	// identical upload again. Not stored in DB.
+	Deduplicated bool `json:"deduplicated,omitempty"`
+
 	AverageColor RGB `json:"averageColor"`
 
+	// Dominant colors of the default image, most dominant first. Nil for images
+	// that have not been backfilled yet.
+	Palette []PaletteColor `json:"palette"`
+
+	// Perceptual hash of the default image. Nil for images saved before
+	// perceptual hashes were computed that have not been backfilled yet.
+	PerceptualHash *PerceptualHash `json:"perceptualHash,omitempty"`
+
+	// BlurHash of the default image, for rendering a placeholder while the
+	// image loads. Empty for images that have not been backfilled yet.
+	BlurHash string `json:"blurHash,omitempty"`
+
+	// Name of the preset the image was uploaded with, if any.
+	Preset string `json:"preset,omitempty"`
+
+	// Images in images table are always JobReady. Images uploaded
+	// asynchronously are reported with the status of their job until then.
+	Status string `json:"status"`
+
 	// Copies are stored on disk (in appropriate folders) with filename
-	// {ID}_{MaxWidth}_{MaxHeight}_{ImageFit}.jpg Copies may be nil.
+	// {ID}_{MaxWidth}_{MaxHeight}_{ImageFit}.{ext} Copies may be nil.
 	Copies []*ImageCopy `json:"copies"`
 
 	CreatedAt time.Time  `json:"createdAt"`
 	IsDeleted bool       `json:"deleted"`
 	DeletedAt *time.Time `json:"deletedAt,omitempty"`
 
-	// URL pathname of the image. Is of the format /images/{FolderID}/{ID}.jpg.
+	// Time the files of the deleted image were permanently removed. A purged
+	// image cannot be restored.
+	PurgedAt *time.Time `json:"purgedAt,omitempty"`
+
+	// URL pathname of the image. Is of the format /images/{Folder}/{ID}.{ext},
+	// where ext is jpg or webp depending on Type.
 	URL string `json:"url,omitempty"`
 
 	// URL pathnames of the image and all its copies.
 	URLs []string `json:"urls,omitempty"`
+
+	// Content negotiated URL pathnames of the image and its copies, one per
+	// size and fit. They are of the format /images/{Folder}/{ID}, without an
+	// extension, and the type served depends on the Accept header of the
+	// request.
+	NegotiatedURLs []string `json:"negotiatedUrls,omitempty"`
 }
 
-// GenerateURLs populates i.URL and i.URLs fields.
-func (i *DBImage) GenerateURLs() {
-	folderID := strconv.Itoa(i.FolderID)
-	ID := i.ID.String()
-	i.URL = "/images/" + folderID + "/" + ID + ".jpg"
+// GenerateURLs populates i.URL, i.URLs, and i.NegotiatedURLs fields. If secret
+// is non-empty, URLs of copies are signed with it.
+func (i *DBImage) GenerateURLs(secret string) {
+	sign := func(u string) string {
+		if secret == "" {
+			return u
+		}
+		signed, _ := urlsign.Sign([]byte(secret), u)
+		return signed
+	}
+
+	base := "/images/" + i.Folder + "/" + i.ID.String()
+	i.URL = base + i.Type.Extension()
 
-	i.URLs = append(i.URLs, i.URL)
+	i.URLs = []string{i.URL}
+	i.NegotiatedURLs = []string{base}
+	seen := make(map[string]bool)
 	for _, item := range i.Copies {
+		if item.Variant {
+			i.URLs = append(i.URLs, base+item.Type.Extension())
+			continue
+		}
 		q := "size=" + strconv.Itoa(item.MaxWidth) + "x" + strconv.Itoa(item.MaxHeight) + "&fit=" + string(item.ImageFit)
-		i.URLs = append(i.URLs, i.URL+"?"+q)
+		i.URLs = append(i.URLs, sign(base+item.Type.Extension()+"?"+q))
+		if !seen[q] {
+			seen[q] = true
+			i.NegotiatedURLs = append(i.NegotiatedURLs, sign(base+"?"+q))
+		}
 	}
 }
 
@@ -130,6 +231,10 @@ type SaveImageArg struct {
 	MaxHeight int      `json:"maxHeight"`
 	ImageFit  ImageFit `json:"imageFit"`
 
+	// Type is the format the copy is saved as. If empty, ImageTypeDefault is
+	// used.
+	Type ImageType `json:"type"`
+
 	// If true, this is no longer a copy but the default, or the original,
 	// image. There can be only one default copy per image (if multiple
 	// arguments are provided as being default the first one is selected and
@@ -137,20 +242,32 @@ type SaveImageArg struct {
 	IsDefault bool `json:"default"`
 }
 
-// SaveImage saves the image in buf to disk (in a folder inside rootDir) and
+// SaveImage saves the image in buf to store (in a folder chosen by layout) and
 // creates a record in images table. It also creates and stores copies of the
-// image.
+// image. preset is the name of the preset copies are from, or empty.
 //
-// All images are saved as JPEGs (for now).
-func SaveImage(db *sql.DB, buf []byte, copies []SaveImageArg, rootDir string) (*DBImage, error) {
+// Each copy, including the default one, is saved as the ImageType given in its
+// argument.
+func SaveImage(db *sql.DB, store Storage, layout FolderLayout, buf []byte, copies []SaveImageArg, preset string) (*DBImage, error) {
+	ID, _ := luid.New()
+	return saveImage(db, store, layout, ID, buf, copies, preset, false)
+}
+
+// saveImage is SaveImage for an image with ID, whose creation time is the time
+// of the ID. If job is true, ID is also the ID of a job, whose image_id is set
+// in the same transaction as the image is saved or deduplicated.
+func saveImage(db *sql.DB, store Storage, layout FolderLayout, ID luid.ID, buf []byte, copies []SaveImageArg, preset string, job bool) (*DBImage, error) {
 	if len(buf) == 0 {
 		return nil, ErrNoImage
 	}
 
 	var defaultCopy SaveImageArg
-	for _, item := range copies {
+	for i, item := range copies {
+		if item.Type == "" {
+			copies[i].Type = ImageTypeDefault
+		}
 		if item.IsDefault {
-			defaultCopy = item
+			defaultCopy = copies[i]
 		}
 	}
 
@@ -158,7 +275,14 @@ func SaveImage(db *sql.DB, buf []byte, copies []SaveImageArg, rootDir string) (*
 		return nil, ErrNoDefaultImage
 	}
 
-	jpg, size, err := ToJPEG(buf, defaultCopy.MaxWidth, defaultCopy.MaxHeight, defaultCopy.ImageFit)
+	hash := sha256.Sum256(buf)
+	argsHash := hashSaveImageArgs(copies, preset)
+	jobID := luid.NullID{ID: ID, Valid: job}
+	if image, err := dedupImage(db, hash[:], argsHash, jobID); err != nil || image != nil {
+		return image, err
+	}
+
+	img, size, err := ToImageType(buf, defaultCopy.MaxWidth, defaultCopy.MaxHeight, defaultCopy.ImageFit, defaultCopy.Type)
 	if err != nil {
 		return nil, err
 	}
@@ -168,32 +292,44 @@ func SaveImage(db *sql.DB, buf []byte, copies []SaveImageArg, rootDir string) (*
 		return nil, err
 	}
 
-	tx, err := db.Begin()
+	now := ID.Time()
+
+	folderID, folder, err := reserveFolderSlot(db, layout, ID)
 	if err != nil {
 		return nil, err
 	}
 
-	folderID, err := createImagesFolder(tx, rootDir)
+	tx, err := db.Begin()
 	if err != nil {
-		tx.Rollback()
+		releaseFolderSlot(db, folderID)
 		return nil, err
 	}
 
-	ID, now := luid.New()
-	folder := filepath.Join(rootDir, strconv.Itoa(folderID))
+	// Files are written to temporary names and renamed to their real names
+	// just before the transaction commits, so that a committed image always
+	// has its files. On failure all of them are removed; if the process dies
+	// before the commit, they are orphans that fsck removes.
+	files := &stagedFiles{store: store}
+	fail := func(err error) (*DBImage, error) {
+		tx.Rollback()
+		files.cleanup()
+		if err2 := releaseFolderSlot(db, folderID); err2 != nil {
+			log.Println("Error releasing place in folder "+strconv.Itoa(folderID)+":", err2)
+		}
+		return nil, err
+	}
 
 	// save and save copies.
 	var savedCopies []*ImageCopy
-	var containSizes []ImageSize // saved contain images
+	var containSizes []ImageCopy // saved contain images
 	if defaultCopy.ImageFit == ImageFitContain {
-		containSizes = append(containSizes, ImageSize{size.Width, size.Height})
+		containSizes = append(containSizes, ImageCopy{Width: size.Width, Height: size.Height, Type: defaultCopy.Type})
 	}
-	if err = ioutil.WriteFile(filepath.Join(folder, ID.String()+".jpg"), jpg, 0755); err != nil {
-		tx.Rollback()
-		return nil, err
+	if err = files.put(imageFilePath(folder, ID.String()+defaultCopy.Type.Extension()), img); err != nil {
+		return fail(err)
 	}
 	// Save copies to disk. ImageFit contain copies are skipped if a copy is
-	// already saved with the same width and height.
+	// already saved with the same width, height, and type.
 	for _, item := range copies {
 		if item.IsDefault {
 			continue
@@ -202,7 +338,7 @@ func SaveImage(db *sql.DB, buf []byte, copies []SaveImageArg, rootDir string) (*
 			w, h := ContainInResolution(originalWidth, originalHeight, item.MaxWidth, item.MaxHeight)
 			skip := false
 			for _, size := range containSizes {
-				if size.Width == w && size.Height == h {
+				if size.Width == w && size.Height == h && size.Type == item.Type {
 					skip = true
 					break
 				}
@@ -211,57 +347,236 @@ func SaveImage(db *sql.DB, buf []byte, copies []SaveImageArg, rootDir string) (*
 				continue
 			}
 		}
-		c, err := saveImageCopy(buf, item, folder, ID.String())
+		c, data, err := makeImageCopy(buf, item)
 		if err != nil {
-			tx.Rollback()
-			return nil, err
+			return fail(err)
+		}
+		if err = files.put(imageFilePath(folder, c.Filename(ID.String())), data); err != nil {
+			return fail(err)
 		}
 		savedCopies = append(savedCopies, c)
 		if item.ImageFit == ImageFitContain {
-			containSizes = append(containSizes, ImageSize{c.Width, c.Height})
+			containSizes = append(containSizes, *c)
 		}
 	}
 
-	// calculate image prominent color.
-	jpegImage, err := jpeg.Decode(bytes.NewReader(jpg))
+	// calculate image prominent colors.
+	decoded, err := decodeForAnalysis(img)
 	if err != nil {
-		tx.Rollback()
-		return nil, err
+		return fail(err)
+	}
+	color, _ := json.Marshal(AverageColor(decoded))
+	palette, _ := json.Marshal(Palette(decoded, PaletteSize))
+	phash := DHash(decoded)
+	blurHash, err := BlurHash(decoded)
+	if err != nil {
+		return fail(err)
 	}
-	color, _ := json.Marshal(AverageColor(jpegImage))
 
 	savedCopiesJSON, _ := json.Marshal(savedCopies)
 
 	_, err = tx.Exec(`insert into images (id, folder_id, width, height,
-		max_width, max_height, type, size, uploaded_size, copies, average_color, created_at)
-		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		max_width, max_height, type, size, uploaded_size, copies, average_color, palette, phash,
+		blurhash, preset, hash, args_hash, created_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		ID, folderID, size.Width, size.Height, defaultCopy.MaxWidth, defaultCopy.MaxHeight,
-		ImageTypeJPEG, len(jpg), len(buf), savedCopiesJSON, color, now)
+		defaultCopy.Type, len(img), len(buf), savedCopiesJSON, color, palette, int64(phash), blurHash,
+		sql.NullString{String: preset, Valid: preset != ""}, hash[:], argsHash, now)
+	if err != nil {
+		fail(err)
+		if isDuplicateKey(err) {
+			// An identical upload was saved meanwhile.
+			if image, err2 := dedupImage(db, hash[:], argsHash, jobID); err2 != nil || image != nil {
+				return image, err2
+			}
+		}
+		return nil, err
+	}
+
+	if _, err = tx.Exec("update folders set total_size = total_size + ? where id = ?", len(img), folderID); err != nil {
+		return fail(err)
+	}
+
+	if job {
+		if _, err = tx.Exec("update jobs set image_id = ? where id = ?", ID, ID); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err = files.commit(); err != nil {
+		return fail(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	return GetImage(db, ID)
+}
+
+// tempFileSuffix is appended to the names of files staged by stagedFiles.
+const tempFileSuffix = ".tmp"
+
+// stagedFiles puts files in store under temporary names, unique to the
+// stagedFiles. The files are given their real names only when commit is
+// called.
+type stagedFiles struct {
+	store     Storage
+	names     []string // real names of files put
+	token     string   // part of the temporary names
+	committed int      // number of files renamed by commit
+}
+
+func (s *stagedFiles) tempName(name string) string {
+	if s.token == "" {
+		ID, _ := luid.New()
+		s.token = ID.String()
+	}
+	return name + "." + s.token + tempFileSuffix
+}
+
+func (s *stagedFiles) put(name string, data []byte) error {
+	s.names = append(s.names, name)
+	return s.store.Put(s.tempName(name), data)
+}
+
+// commit renames all files put to their real names.
+func (s *stagedFiles) commit() error {
+	for _, name := range s.names[s.committed:] {
+		if err := s.store.Rename(s.tempName(name), name); err != nil {
+			return err
+		}
+		s.committed++
+	}
+	return nil
+}
+
+// cleanup deletes all files put: the temporary files of those not committed
+// and the real files of those committed. Files of the same names put by others
+// are left alone.
+func (s *stagedFiles) cleanup() {
+	for i, name := range s.names {
+		n := s.tempName(name)
+		if i < s.committed {
+			n = name
+		}
+		if err := s.store.Delete(n); err != nil && !os.IsNotExist(err) {
+			log.Println("Error deleting file "+n+":", err)
+		}
+	}
+}
+
+// discard deletes the temporary files of files put that are not committed,
+// leaving committed files in place. It is used instead of cleanup when files
+// replace existing ones, which cannot be restored.
+func (s *stagedFiles) discard() {
+	for _, name := range s.names[s.committed:] {
+		n := s.tempName(name)
+		if err := s.store.Delete(n); err != nil && !os.IsNotExist(err) {
+			log.Println("Error deleting file "+n+":", err)
+		}
+	}
+}
+
+// hashSaveImageArgs returns a hash of args and preset that does not depend on
+// the order of args. The preset is part of the hash so that an upload is never
+// deduplicated to an image of another preset.
+func hashSaveImageArgs(args []SaveImageArg, preset string) []byte {
+	items := make([]string, len(args))
+	for i, item := range args {
+		data, _ := json.Marshal(item)
+		items[i] = string(data)
+	}
+	if preset != "" {
+		// Cannot collide with an arg, which is a JSON object.
+		items = append(items, "preset "+preset)
+	}
+	sort.Strings(items)
+	data, _ := json.Marshal(items)
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// dedupImage returns the non-deleted image that was saved from an upload with
+// hash, using arguments with argsHash, after incrementing its reference count.
+// If jobID is valid, the image_id of the job is set in the same transaction. It
+// returns nil if no such image exists.
+func dedupImage(db *sql.DB, hash, argsHash []byte, jobID luid.NullID) (*DBImage, error) {
+	tx, err := db.Begin()
 	if err != nil {
+		return nil, err
+	}
+
+	var ID luid.ID
+	row := tx.QueryRow(`select id from images where hash = ? and args_hash = ? and is_deleted = false
+		limit 1 for update`, hash, argsHash)
+	if err = row.Scan(&ID); err != nil {
 		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
 		return nil, err
 	}
 
-	if _, err = tx.Exec("update folders set images_count = images_count + 1, total_size = total_size + ? where id = ?", len(jpg), folderID); err != nil {
+	if _, err = tx.Exec("update images set ref_count = ref_count + 1 where id = ?", ID); err != nil {
 		tx.Rollback()
 		return nil, err
 	}
 
+	if jobID.Valid {
+		if _, err = tx.Exec("update jobs set image_id = ? where id = ?", ID, jobID.ID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
 	if err = tx.Commit(); err != nil {
 		return nil, err
 	}
 
-	return GetImage(db, ID)
+	image, err := GetImage(db, ID)
+	if err != nil {
+		return nil, err
+	}
+	image.Deduplicated = true
+	return image, nil
+}
+
+// isDuplicateKey reports whether err is a MySQL duplicate key error.
+func isDuplicateKey(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "Error 1062")
+}
+
+// imageFilePath returns the name, in a Storage, of file name of an image in
+// folder (a folder path).
+func imageFilePath(folder string, name string) string {
+	return folder + "/" + name
+}
+
+// saveImageCopy recreates copy c of an image, with imageID in folder, from buf
+// (its default image) and returns the copy made.
+func saveImageCopy(store Storage, buf []byte, c *ImageCopy, folder string, imageID string) (*ImageCopy, error) {
+	made, img, err := makeImageCopy(buf, c.saveImageArg())
+	if err != nil {
+		return nil, err
+	}
+	made.Variant = c.Variant
+
+	if err = store.Put(imageFilePath(folder, made.Filename(imageID)), img); err != nil {
+		return nil, err
+	}
+
+	return made, nil
 }
 
-// folder is rootDir/folderID and it already exists.
-func saveImageCopy(buf []byte, arg SaveImageArg, folder, imageID string) (*ImageCopy, error) {
-	jpeg, size, err := ToJPEG(buf, arg.MaxWidth, arg.MaxHeight, arg.ImageFit)
+// makeImageCopy creates a copy of image buf as described by arg and returns it
+// along with its file contents.
+func makeImageCopy(buf []byte, arg SaveImageArg) (*ImageCopy, []byte, error) {
+	img, size, err := ToImageType(buf, arg.MaxWidth, arg.MaxHeight, arg.ImageFit, arg.Type)
 	if err != nil {
 		if strings.Contains(err.Error(), "Unsupported image format") {
-			return nil, ErrUnsupportedImage
+			return nil, nil, ErrUnsupportedImage
 		}
-		return nil, err
+		return nil, nil, err
 	}
 
 	c := &ImageCopy{
@@ -270,88 +585,417 @@ func saveImageCopy(buf []byte, arg SaveImageArg, folder, imageID string) (*Image
 		Width:     size.Width,
 		Height:    size.Height,
 		ImageFit:  arg.ImageFit,
-		Size:      len(jpeg),
+		Type:      arg.Type,
+		Size:      len(img),
 	}
 
-	if err = ioutil.WriteFile(filepath.Join(folder, c.Filename(imageID)), jpeg, 0755); err != nil {
-		return nil, err
+	return c, img, nil
+}
+
+// errImageMoved is returned by addImageCopy if the image was moved to another
+// folder while its copy was being made.
+var errImageMoved = errors.New("image was moved concurrently")
+
+// AddImageCopy creates a copy of the image with ID, as described by arg, from
+// its default image and appends it to the copies of the image. If such a copy
+// already exists it is returned instead.
+func AddImageCopy(db *sql.DB, store Storage, ID luid.ID, arg SaveImageArg) (*ImageCopy, error) {
+	if arg.Type == "" {
+		arg.Type = ImageTypeDefault
+	}
+	if arg.ImageFit == "" {
+		arg.ImageFit = ImageFitDefault
 	}
 
-	return c, nil
+	return addImageCopyRetrying(db, store, ID, arg, false)
 }
 
-// createImagesFolder creates a folder on disk and a record on folders table if
-// no folders are available (or if the folder is full) or returns the last
-// folder id.
-func createImagesFolder(tx *sql.Tx, rootDir string) (int, error) {
-	var folderID, imagesCount int
-	createFolder := false
+// errVariantOfOwnType is returned by AddImageVariant for the type of the
+// default image itself.
+var errVariantOfOwnType = errors.New("default image is already of the type")
 
-	row := tx.QueryRow("select id, images_count from folders order by id desc limit 1")
-	if err := row.Scan(&folderID, &imagesCount); err != nil {
-		if err == sql.ErrNoRows {
-			createFolder = true
-		} else {
-			return 0, err
+// AddImageVariant saves the default image of the image with ID also as type t,
+// as a variant (see ImageCopy), and appends it to the copies of the image. If
+// such a variant already exists it is returned instead.
+func AddImageVariant(db *sql.DB, store Storage, ID luid.ID, t ImageType) (*ImageCopy, error) {
+	return addImageCopyRetrying(db, store, ID, SaveImageArg{Type: t}, true)
+}
+
+// addImageCopyRetrying calls addImageCopy, retrying a few times if the image is
+// moved by MoveImages meanwhile.
+func addImageCopyRetrying(db *sql.DB, store Storage, ID luid.ID, arg SaveImageArg, variant bool) (*ImageCopy, error) {
+	for i := 0; ; i++ {
+		c, err := addImageCopy(db, store, ID, arg, variant)
+		if err != errImageMoved || i == 2 {
+			return c, err
 		}
 	}
+}
 
-	if imagesCount >= MaxImagesPerFolder {
-		createFolder = true
+// addImageCopy adds the copy of the image with ID described by arg or, if
+// variant, the variant of type arg.Type.
+func addImageCopy(db *sql.DB, store Storage, ID luid.ID, arg SaveImageArg, variant bool) (*ImageCopy, error) {
+	image, err := GetImage(db, ID)
+	if err != nil {
+		return nil, err
+	}
+	if image.IsDeleted {
+		return nil, ErrImageDeleted
+	}
+	if variant {
+		if arg.Type.Extension() == image.Type.Extension() {
+			return nil, errVariantOfOwnType
+		}
+		arg = SaveImageArg{MaxWidth: image.Width, MaxHeight: image.Height, ImageFit: ImageFitContain, Type: arg.Type}
+	}
+	exists := func(c *ImageCopy) bool {
+		if variant {
+			return c.isVariantOf(arg.Type)
+		}
+		return c.isCopyOf(arg)
+	}
+	for _, item := range image.Copies {
+		if exists(item) {
+			return item, nil
+		}
 	}
 
-	if !createFolder {
-		return folderID, nil
+	buf, err := ReadFile(store, imageFilePath(image.Folder, ID.String()+image.Type.Extension()))
+	if err != nil {
+		if os.IsNotExist(err) {
+			if current, err2 := GetImage(db, ID); err2 == nil && current.FolderID != image.FolderID {
+				return nil, errImageMoved
+			}
+		}
+		return nil, err
 	}
 
-	res, err := tx.Exec("insert into folders () values ()")
+	// The copy is made and staged without holding a lock on the image, and
+	// given its real name only once it is known to be new.
+	c, data, err := makeImageCopy(buf, arg)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	c.Variant = variant
+	files := &stagedFiles{store: store}
+	if err = files.put(imageFilePath(image.Folder, c.Filename(ID.String())), data); err != nil {
+		files.cleanup()
+		return nil, err
 	}
 
-	ID, err := res.LastInsertId()
+	tx, err := db.Begin()
 	if err != nil {
-		return 0, err
+		files.cleanup()
+		return nil, err
+	}
+	fail := func(err error) (*ImageCopy, error) {
+		tx.Rollback()
+		files.cleanup()
+		return nil, err
+	}
+
+	var folderID int
+	var isDeleted bool
+	var copiesJSON []byte
+	row := tx.QueryRow("select folder_id, is_deleted, copies from images where id = ? for update", ID)
+	if err = row.Scan(&folderID, &isDeleted, &copiesJSON); err != nil {
+		return fail(err)
+	}
+	if folderID != image.FolderID {
+		return fail(errImageMoved)
+	}
+	if isDeleted {
+		return fail(ErrImageDeleted)
+	}
+	var copies []*ImageCopy
+	if len(copiesJSON) > 0 {
+		if err = json.Unmarshal(copiesJSON, &copies); err != nil {
+			return fail(errors.New("error unmarshaling copies: " + err.Error()))
+		}
+	}
+	for _, item := range copies {
+		if exists(item) {
+			tx.Rollback()
+			files.cleanup()
+			return item, nil
+		}
 	}
 
-	return int(ID), os.MkdirAll(filepath.Join(rootDir, strconv.Itoa(int(ID))), 0755)
+	copiesJSON, _ = json.Marshal(append(copies, c))
+	if _, err = tx.Exec("update images set copies = ? where id = ?", copiesJSON, ID); err != nil {
+		return fail(err)
+	}
+
+	if err = files.commit(); err != nil {
+		return fail(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	return c, nil
 }
 
-// GetImage returns an image from DB. It may return a deleted image.
-func GetImage(db *sql.DB, ID luid.ID) (*DBImage, error) {
-	st, err := db.Prepare(`select id, folder_id, type, width, height, max_width, max_height,
-		size, uploaded_size, average_color, copies, created_at, is_deleted,
-		deleted_at from images where id = ?`)
+// RemoveImageCopy removes the copies of the image with ID of size and fit, of
+// type t or of all types if t is empty, from the copies of the image and
+// deletes their files. It returns ErrCopyNotFound if there are no such copies.
+func RemoveImageCopy(db *sql.DB, store Storage, ID luid.ID, size ImageSize, fit ImageFit, t ImageType) (*DBImage, error) {
+	tx, err := db.Begin()
 	if err != nil {
 		return nil, err
 	}
 
-	row := st.QueryRow(ID)
-	image := &DBImage{}
-	var copies, color []byte
+	var isDeleted bool
+	var copiesJSON []byte
+	row := tx.QueryRow("select is_deleted, copies from images where id = ? for update", ID)
+	if err = row.Scan(&isDeleted, &copiesJSON); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if isDeleted {
+		tx.Rollback()
+		return nil, ErrImageDeleted
+	}
+	var copies []*ImageCopy
+	if len(copiesJSON) > 0 {
+		if err = json.Unmarshal(copiesJSON, &copies); err != nil {
+			tx.Rollback()
+			return nil, errors.New("error unmarshaling copies: " + err.Error())
+		}
+	}
+
+	var kept, removed []*ImageCopy
+	for _, item := range copies {
+		if !item.Variant && item.MaxWidth == size.Width && item.MaxHeight == size.Height && item.ImageFit == fit &&
+			(t == "" || item.Type.Extension() == t.Extension()) {
+			removed = append(removed, item)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	if len(removed) == 0 {
+		tx.Rollback()
+		return nil, ErrCopyNotFound
+	}
+
+	copiesJSON, _ = json.Marshal(kept)
+	if _, err = tx.Exec("update images set copies = ? where id = ?", copiesJSON, ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	image, err := GetImage(db, ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files are deleted only after the copies are removed from DB, so that
+	// no copy in DB is ever without its file.
+	for _, item := range removed {
+		name := imageFilePath(image.Folder, item.Filename(ID.String()))
+		if err = store.Delete(name); err != nil && !os.IsNotExist(err) {
+			log.Println("Error deleting copy "+name+":", err)
+		}
+	}
+
+	return image, nil
+}
+
+// imageColumns are the columns of images table scanned by scanImage.
+const imageColumns = `id, folder_id,
+	(select coalesce(f.path, f.id) from folders f where f.id = images.folder_id), type, width, height, max_width, max_height,
+	size, uploaded_size, ref_count, average_color, palette, phash, blurhash, preset, copies,
+	created_at, is_deleted, deleted_at, purged_at`
 
-	err = row.Scan(&image.ID, &image.FolderID, &image.Type, &image.Width, &image.Height,
-		&image.MaxWidth, &image.MaxHeight, &image.Size, &image.UploadedSize, &color,
-		&copies, &image.CreatedAt, &image.IsDeleted, &image.DeletedAt)
+// scanImage scans a row of imageColumns.
+func scanImage(row interface{ Scan(...interface{}) error }) (*DBImage, error) {
+	image := &DBImage{}
+	var copies, color, palette []byte
+	var phash sql.NullInt64
+	var blurHash, preset sql.NullString
+
+	err := row.Scan(&image.ID, &image.FolderID, &image.Folder, &image.Type, &image.Width, &image.Height,
+		&image.MaxWidth, &image.MaxHeight, &image.Size, &image.UploadedSize, &image.RefCount, &color,
+		&palette, &phash, &blurHash, &preset, &copies, &image.CreatedAt, &image.IsDeleted, &image.DeletedAt,
+		&image.PurgedAt)
 	if err != nil {
 		return nil, err
 	}
 
+	if phash.Valid {
+		h := PerceptualHash(phash.Int64)
+		image.PerceptualHash = &h
+	}
+	image.BlurHash = blurHash.String
+	image.Preset = preset.String
+	image.Status = JobReady
+
 	if err = json.Unmarshal(color, &image.AverageColor); err != nil {
 		return nil, errors.New("error unmarshaling color: " + err.Error())
 	}
+	if len(palette) > 0 {
+		if err = json.Unmarshal(palette, &image.Palette); err != nil {
+			return nil, errors.New("error unmarshaling palette: " + err.Error())
+		}
+	}
 	if err = json.Unmarshal(copies, &image.Copies); err != nil {
 		return nil, errors.New("error unmarshaling copies: " + err.Error())
 	}
 
-	image.GenerateURLs()
+	image.GenerateURLs("")
 
 	return image, nil
 }
 
-// DeleteImage sets is_deleted field of images to true. If deletedDir is
-// non-empty, images are moved to that directory. Otherwise they are deleted.
-func DeleteImage(db *sql.DB, ID luid.ID, rootDir, deletedDir string) (*DBImage, error) {
+// GetImage returns an image from DB. It may return a deleted image. URLs of the
+// image are not signed.
+func GetImage(db *sql.DB, ID luid.ID) (*DBImage, error) {
+	return scanImage(db.QueryRow("select "+imageColumns+" from images where id = ?", ID))
+}
+
+// DeletedFilter determines whether deleted images are listed by GetImages.
+type DeletedFilter string
+
+// Valid DeletedFilter values.
+const (
+	DeletedExclude = DeletedFilter("exclude")
+	DeletedInclude = DeletedFilter("include")
+	DeletedOnly    = DeletedFilter("only")
+)
+
+// UnmarshalText implements encoding.TextUnmarshaler interface. Empty text is
+// DeletedExclude.
+func (f *DeletedFilter) UnmarshalText(text []byte) error {
+	str := string(text)
+	switch str {
+	case string(DeletedExclude), string(DeletedInclude), string(DeletedOnly):
+		*f = DeletedFilter(str)
+		return nil
+	case "":
+		*f = DeletedExclude
+		return nil
+	}
+	return errors.New("invalid deleted filter")
+}
+
+// GetImagesArg is an argument to GetImages.
+type GetImagesArg struct {
+	// Only images with IDs greater than After are returned. If After is not
+	// valid, images are returned from the first one.
+	After luid.NullID
+
+	// Maximum number of images to return.
+	Limit int
+
+	Deleted DeletedFilter
+
+	// If non-zero, only images in this folder are returned.
+	FolderID int
+}
+
+// GetImages returns images in the order they were created (which is the order
+// of their IDs). To get the next page, call GetImages again with After set to
+// the ID of the last image returned. URLs of the images are not signed.
+func GetImages(db *sql.DB, arg GetImagesArg) ([]*DBImage, error) {
+	var where []string
+	var args []interface{}
+	if arg.After.Valid {
+		where = append(where, "id > ?")
+		args = append(args, arg.After.ID)
+	}
+	switch arg.Deleted {
+	case DeletedOnly:
+		where = append(where, "is_deleted = true")
+	case DeletedInclude:
+	default:
+		where = append(where, "is_deleted = false")
+	}
+	if arg.FolderID != 0 {
+		where = append(where, "folder_id = ?")
+		args = append(args, arg.FolderID)
+	}
+
+	query := "select " + imageColumns + " from images"
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += " order by id limit ?"
+	args = append(args, arg.Limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []*DBImage{}
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+
+	return images, rows.Err()
+}
+
+// SimilarImage is an image that is similar to another image.
+type SimilarImage struct {
+	Image *DBImage `json:"image"`
+
+	// Hamming distance between the perceptual hashes of the two images.
+	Distance int `json:"distance"`
+}
+
+// GetSimilarImages returns at most limit non-deleted images whose perceptual
+// hashes are within maxDistance of the hash of the image with ID, closest
+// first. It returns nil if the image has no perceptual hash.
+func GetSimilarImages(db *sql.DB, ID luid.ID, maxDistance, limit int) ([]*SimilarImage, error) {
+	var phash sql.NullInt64
+	if err := db.QueryRow("select phash from images where id = ?", ID).Scan(&phash); err != nil {
+		return nil, err
+	}
+	if !phash.Valid {
+		return nil, nil
+	}
+
+	rows, err := db.Query(`select id, bit_count(phash ^ ?) as distance from images
+		where phash is not null and is_deleted = false and id != ? having distance <= ?
+		order by distance limit ?`, phash.Int64, ID, maxDistance, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []*SimilarImage
+	for rows.Next() {
+		item := &SimilarImage{}
+		var imageID luid.ID
+		if err = rows.Scan(&imageID, &item.Distance); err != nil {
+			return nil, err
+		}
+		if item.Image, err = GetImage(db, imageID); err != nil {
+			return nil, err
+		}
+		images = append(images, item)
+	}
+
+	return images, rows.Err()
+}
+
+// DeleteImage sets is_deleted field of images to true. If deleted is non-nil,
+// the default image is moved to it. Otherwise it is deleted. Copies are always
+// deleted.
+//
+// If the image was saved from more than one identical upload, only its
+// reference count is decremented.
+func DeleteImage(db *sql.DB, ID luid.ID, store, deleted Storage) (*DBImage, error) {
 	image, err := GetImage(db, ID)
 	if err != nil {
 		return nil, err
@@ -366,7 +1010,24 @@ func DeleteImage(db *sql.DB, ID luid.ID, rootDir, deletedDir string) (*DBImage,
 		return nil, err
 	}
 
-	st, err := tx.Prepare("update images set is_deleted = ?, deleted_at = ? where id = ?")
+	var refCount int
+	if err = tx.QueryRow("select ref_count from images where id = ? for update", ID).Scan(&refCount); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if refCount > 1 {
+		if _, err = tx.Exec("update images set ref_count = ref_count - 1 where id = ?", ID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		image.RefCount = refCount - 1
+		return image, nil
+	}
+
+	st, err := tx.Prepare("update images set is_deleted = ?, deleted_at = ?, ref_count = 0 where id = ?")
 	if err != nil {
 		tx.Rollback()
 		return nil, err
@@ -380,21 +1041,20 @@ func DeleteImage(db *sql.DB, ID luid.ID, rootDir, deletedDir string) (*DBImage,
 
 	// copy original to deleted images folder
 	prefix := image.ID.String()
-	if deletedDir != "" {
-		originalPath := filepath.Join(rootDir, strconv.Itoa(image.FolderID), prefix+".jpg")
-		data, err := ioutil.ReadFile(originalPath)
+	if deleted != nil {
+		data, err := ReadFile(store, imageFilePath(image.Folder, prefix+image.Type.Extension()))
 		if err != nil {
 			tx.Rollback()
 			return nil, err
 		}
-		if err = ioutil.WriteFile(filepath.Join(deletedDir, prefix+".jpg"), data, 0755); err != nil {
+		if err = deleted.Put(prefix+image.Type.Extension(), data); err != nil {
 			tx.Rollback()
 			return nil, err
 		}
 	}
 
-	// delete files on disk
-	if _, err = deleteFilesByPrefix(filepath.Join(rootDir, strconv.Itoa(image.FolderID)), prefix); err != nil {
+	// delete files in storage
+	if _, err = store.DeletePrefix(imageFilePath(image.Folder, prefix)); err != nil {
 		tx.Rollback()
 		return nil, err
 	}
@@ -405,34 +1065,120 @@ func DeleteImage(db *sql.DB, ID luid.ID, rootDir, deletedDir string) (*DBImage,
 
 	image.DeletedAt = &now
 	image.IsDeleted = true
+	image.RefCount = 0
 
 	return image, nil
 }
 
-// deleteFilesByPrefix deletes all files in dir with filename prefix s and
-// returns the number of files deleted. If an error is encounted no of files
-// deleted up to that point is returned.
-func deleteFilesByPrefix(dir, s string) (int, error) {
-	file, err := os.Open(dir)
+// RestoreImage undoes DeleteImage: it moves the default image of the deleted
+// image with ID from deleted back to store, regenerates the copies of the
+// image from it, and sets is_deleted field of the image to false. It returns
+// ErrImagePurged if the image has been purged or its default image is otherwise
+// no longer in deleted (or if deleted is nil). Restoring an image that is not
+// deleted does nothing.
+func RestoreImage(db *sql.DB, ID luid.ID, store, deleted Storage) (*DBImage, error) {
+	image, err := GetImage(db, ID)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	defer file.Close()
 
-	names, err := file.Readdirnames(0)
-	if err != nil {
-		return 0, err
+	if !image.IsDeleted {
+		return image, nil
 	}
 
-	n := 0
-	for _, name := range names {
-		if strings.HasPrefix(name, s) {
-			if err = os.Remove(filepath.Join(dir, name)); err != nil {
-				return n, err
+	if deleted == nil || image.PurgedAt != nil {
+		return nil, ErrImagePurged
+	}
+
+	name := ID.String() + image.Type.Extension()
+	buf, err := ReadFile(deleted, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The file is also removed by a concurrent restore.
+			if image, err = GetImage(db, ID); err == nil && !image.IsDeleted {
+				return image, nil
 			}
-			n++
+			return nil, ErrImagePurged
 		}
+		return nil, err
 	}
 
-	return n, nil
+	// Copies are regenerated from the default image, as the original upload
+	// is not kept. Files are staged before the image is locked, so that the
+	// lock is not held while the copies are made.
+	files := &stagedFiles{store: store}
+	if err = files.put(imageFilePath(image.Folder, name), buf); err != nil {
+		files.cleanup()
+		return nil, err
+	}
+	var copies []*ImageCopy
+	for _, item := range image.Copies {
+		c, data, err := makeImageCopy(buf, item.saveImageArg())
+		if err == nil {
+			c.Variant = item.Variant
+			err = files.put(imageFilePath(image.Folder, c.Filename(ID.String())), data)
+		}
+		if err != nil {
+			files.cleanup()
+			return nil, err
+		}
+		copies = append(copies, c)
+	}
+	copiesJSON, _ := json.Marshal(copies)
+
+	tx, err := db.Begin()
+	if err != nil {
+		files.cleanup()
+		return nil, err
+	}
+	fail := func(err error) (*DBImage, error) {
+		tx.Rollback()
+		files.cleanup()
+		return nil, err
+	}
+
+	// The image may have been restored, purged, or moved meanwhile.
+	var isDeleted, isPurged bool
+	var folderID int
+	row := tx.QueryRow("select is_deleted, purged_at is not null, folder_id from images where id = ? for update", ID)
+	if err = row.Scan(&isDeleted, &isPurged, &folderID); err != nil {
+		return fail(err)
+	}
+	if !isDeleted {
+		tx.Rollback()
+		files.cleanup()
+		return GetImage(db, ID)
+	}
+	if isPurged {
+		return fail(ErrImagePurged)
+	}
+	if folderID != image.FolderID {
+		return fail(errors.New("image was moved concurrently"))
+	}
+
+	const query = `update images set is_deleted = false, deleted_at = null, ref_count = 1,
+		copies = ?, hash = if(?, null, hash) where id = ? and is_deleted = true and purged_at is null`
+	_, err = tx.Exec(query, copiesJSON, false, ID)
+	if isDuplicateKey(err) {
+		// An identical image was uploaded while this one was deleted. The
+		// restored image is left out of deduplication.
+		_, err = tx.Exec(query, copiesJSON, true, ID)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if err = files.commit(); err != nil {
+		return fail(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	if err = deleted.Delete(name); err != nil {
+		log.Println("Error removing restored image from deleted images:", err)
+	}
+
+	return GetImage(db, ID)
 }
@@ -0,0 +1,519 @@
+package citra
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// openTestDB opens the database in environment variable CITRA_TEST_DSN, for
+// example "user:password@/citra_test?parseTime=true", and runs the
+// migrations. The test is skipped if the variable is not set.
+func openTestDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("CITRA_TEST_DSN")
+	if dsn == "" {
+		t.Skip("CITRA_TEST_DSN not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = RunMigrations(db); err != nil {
+		t.Fatal("RunMigrations: ", err)
+	}
+	return db
+}
+
+var testJPEGSeed = time.Now().UnixNano()
+
+// testJPEG returns a JPEG image of random noise, so that it is never
+// deduplicated. It is safe for concurrent use.
+func testJPEG(t *testing.T) []byte {
+	r := rand.New(rand.NewSource(atomic.AddInt64(&testJPEGSeed, 1)))
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256)), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var errInjected = errors.New("injected failure")
+
+// failingStorage is a Storage whose failAt'th Put or Rename (counting from 0)
+// fails.
+type failingStorage struct {
+	Storage
+	failAt int
+	n      int
+}
+
+func (s *failingStorage) fail() error {
+	s.n++
+	if s.n-1 == s.failAt {
+		return errInjected
+	}
+	return nil
+}
+
+func (s *failingStorage) Put(name string, data []byte) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.Storage.Put(name, data)
+}
+
+func (s *failingStorage) Rename(oldName, newName string) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.Storage.Rename(oldName, newName)
+}
+
+// failingConnector connects to a mysql DB whose failAt'th statement executed
+// or transaction committed (counting from 0, on all its connections) fails.
+// Queries are not counted.
+type failingConnector struct {
+	dsn    string
+	failAt int64
+	n      int64
+}
+
+func (c *failingConnector) fail() error {
+	if atomic.AddInt64(&c.n, 1)-1 == c.failAt {
+		return errInjected
+	}
+	return nil
+}
+
+func (c *failingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &failingConn{Conn: conn, c: c}, nil
+}
+
+func (c *failingConnector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
+
+type failingConn struct {
+	driver.Conn
+	c *failingConnector
+}
+
+func (conn *failingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := conn.c.fail(); err != nil {
+		return nil, err
+	}
+	return conn.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (conn *failingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return conn.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (conn *failingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := conn.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &failingTx{Tx: tx, c: conn.c}, nil
+}
+
+type failingTx struct {
+	driver.Tx
+	c *failingConnector
+}
+
+func (tx *failingTx) Commit() error {
+	if err := tx.c.fail(); err != nil {
+		tx.Tx.Rollback()
+		return err
+	}
+	return tx.Tx.Commit()
+}
+
+// openFailingTestDB opens the test database through a failingConnector that
+// fails at failAt. openTestDB must have been called first.
+func openFailingTestDB(t *testing.T, failAt int64) *sql.DB {
+	db := sql.OpenDB(&failingConnector{dsn: os.Getenv("CITRA_TEST_DSN"), failAt: failAt})
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// dbTotals returns the number of images and the sums of images_count and
+// total_size of all folders.
+func dbTotals(t *testing.T, db *sql.DB) (images, imagesCount int, totalSize int64) {
+	err := db.QueryRow("select count(*) from images").Scan(&images)
+	if err == nil {
+		err = db.QueryRow("select coalesce(sum(images_count), 0), coalesce(sum(total_size), 0) from folders").
+			Scan(&imagesCount, &totalSize)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// listFiles returns the names of all files under dir.
+func listFiles(t *testing.T, dir string) []string {
+	var names []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			names = append(names, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestStagedFiles(t *testing.T) {
+	names := []string{"1000/a.jpg", "1000/a_400_400_cover.jpg", "1000/a_800_800_contain.jpg"}
+	for failAt := 0; ; failAt++ {
+		dir := t.TempDir()
+		store := &failingStorage{Storage: &DiskStorage{Root: dir}, failAt: failAt}
+		files := &stagedFiles{store: store}
+
+		var err error
+		for _, name := range names {
+			if err = files.put(name, []byte(name)); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = files.commit()
+		}
+
+		if err != nil {
+			files.cleanup()
+			if list := listFiles(t, dir); len(list) > 0 {
+				t.Fatalf("failure at operation %v: files left after cleanup: %v", failAt, list)
+			}
+			continue
+		}
+
+		list := listFiles(t, dir)
+		if len(list) != len(names) {
+			t.Fatalf("want files %v, got %v", names, list)
+		}
+		for _, name := range list {
+			if strings.HasSuffix(name, tempFileSuffix) {
+				t.Fatalf("temporary file %v left after commit", name)
+			}
+		}
+		break
+	}
+}
+
+func TestSaveImageFailures(t *testing.T) {
+	db := openTestDB(t)
+	copies := []SaveImageArg{
+		{MaxWidth: 1920, MaxHeight: 1080, ImageFit: ImageFitContain, IsDefault: true},
+		{MaxWidth: 32, MaxHeight: 32, ImageFit: ImageFitCover},
+		{MaxWidth: 16, MaxHeight: 16, ImageFit: ImageFitContain, Type: ImageTypeWEBP},
+	}
+
+	for failAt := 0; ; failAt++ {
+		buf := testJPEG(t)
+		dir := t.TempDir()
+		store := &failingStorage{Storage: &DiskStorage{Root: dir}, failAt: failAt}
+
+		images, count, size := dbTotals(t, db)
+
+		saved, err := SaveImage(db, store, FolderLayout{}, buf, copies, "")
+		if err == nil {
+			if list := listFiles(t, dir); len(list) != len(saved.Copies)+1 {
+				t.Fatalf("want %v files, got %v", len(saved.Copies)+1, list)
+			}
+			break
+		}
+		if err != errInjected {
+			t.Fatalf("failure at operation %v: want injected error, got %v", failAt, err)
+		}
+
+		if images2, count2, size2 := dbTotals(t, db); images2 != images || count2 != count || size2 != size {
+			t.Fatalf("failure at operation %v: images, folder images and size changed from %v, %v, %v to %v, %v, %v",
+				failAt, images, count, size, images2, count2, size2)
+		}
+		if list := listFiles(t, dir); len(list) > 0 {
+			t.Fatalf("failure at operation %v: files left: %v", failAt, list)
+		}
+	}
+
+	// Fail each statement and commit in turn.
+	for failAt := int64(0); ; failAt++ {
+		buf := testJPEG(t)
+		dir := t.TempDir()
+		store := &DiskStorage{Root: dir}
+		failing := openFailingTestDB(t, failAt)
+
+		images, count, size := dbTotals(t, db)
+
+		saved, err := SaveImage(failing, store, FolderLayout{}, buf, copies, "")
+		if err == nil {
+			if list := listFiles(t, dir); len(list) != len(saved.Copies)+1 {
+				t.Fatalf("want %v files, got %v", len(saved.Copies)+1, list)
+			}
+			break
+		}
+		if err != errInjected {
+			t.Fatalf("DB failure at operation %v: want injected error, got %v", failAt, err)
+		}
+
+		if images2, count2, size2 := dbTotals(t, db); images2 != images || count2 != count || size2 != size {
+			t.Fatalf("DB failure at operation %v: images, folder images and size changed from %v, %v, %v to %v, %v, %v",
+				failAt, images, count, size, images2, count2, size2)
+		}
+		if list := listFiles(t, dir); len(list) > 0 {
+			t.Fatalf("DB failure at operation %v: files left: %v", failAt, list)
+		}
+	}
+}
+
+func TestSaveImageConcurrent(t *testing.T) {
+	db := openTestDB(t)
+	store := &DiskStorage{Root: t.TempDir()}
+	copies := []SaveImageArg{{MaxWidth: 64, MaxHeight: 64, ImageFit: ImageFitContain, IsDefault: true}}
+
+	// Start with a folder that has room for only a few images, so that the
+	// uploads below overflow into a new one.
+	const n, room = 40, 5
+	res, err := db.Exec("insert into folders (images_count) values (?)", MaxImagesPerFolder-room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstID, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = testJPEG(t)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for _, buf := range bufs {
+		wg.Add(1)
+		go func(buf []byte) {
+			defer wg.Done()
+			if _, err := SaveImage(db, store, FolderLayout{}, buf, copies, ""); err != nil {
+				errs <- err
+			}
+		}(buf)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal("SaveImage: ", err)
+	}
+
+	rows, err := db.Query(`select f.id, f.images_count, (select count(*) from images where folder_id = f.id)
+		from folders f where f.id >= ? and f.path is null order by f.id`, firstID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var counts []int
+	for rows.Next() {
+		var id, imagesCount, images int
+		if err = rows.Scan(&id, &imagesCount, &images); err != nil {
+			t.Fatal(err)
+		}
+		if imagesCount > MaxImagesPerFolder {
+			t.Fatalf("folder %v has %v images, more than %v", id, imagesCount, MaxImagesPerFolder)
+		}
+		counts = append(counts, images)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(counts) != 2 || counts[0] != room || counts[1] != n-room {
+		t.Fatalf("want %v images in the first folder and %v in one new folder, got %v", room, n-room, counts)
+	}
+}
+
+func TestSaveImageConcurrentDuplicates(t *testing.T) {
+	db := openTestDB(t)
+	store := &DiskStorage{Root: t.TempDir()}
+	buf := testJPEG(t)
+
+	const n = 8
+	var wg sync.WaitGroup
+	images := make(chan *DBImage, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			copies := []SaveImageArg{{MaxWidth: 64, MaxHeight: 64, ImageFit: ImageFitContain, IsDefault: true}}
+			image, err := SaveImage(db, store, FolderLayout{}, buf, copies, "")
+			if err != nil {
+				errs <- err
+				return
+			}
+			images <- image
+		}()
+	}
+	wg.Wait()
+	close(images)
+	close(errs)
+	for err := range errs {
+		t.Fatal("SaveImage: ", err)
+	}
+
+	var first *DBImage
+	for image := range images {
+		if first == nil {
+			first = image
+		} else if image.ID != first.ID {
+			t.Fatalf("want identical uploads deduplicated into one image, got %v and %v", first.ID, image.ID)
+		}
+	}
+	image, err := GetImage(db, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.RefCount != n {
+		t.Fatalf("want ref count %v, got %v", n, image.RefCount)
+	}
+}
+
+func TestSaveImageDedupPreset(t *testing.T) {
+	db := openTestDB(t)
+	store := &DiskStorage{Root: t.TempDir()}
+	buf := testJPEG(t)
+
+	copies := []SaveImageArg{{MaxWidth: 64, MaxHeight: 64, ImageFit: ImageFitContain, IsDefault: true}}
+	a, err := SaveImage(db, store, FolderLayout{}, buf, copies, "avatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := SaveImage(db, store, FolderLayout{}, buf, copies, "banner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID == b.ID {
+		t.Fatalf("want uploads of different presets saved apart, got %v for both", a.ID)
+	}
+	c, err := SaveImage(db, store, FolderLayout{}, buf, copies, "avatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ID != a.ID {
+		t.Fatalf("want uploads of the same preset deduplicated, got %v and %v", a.ID, c.ID)
+	}
+}
+
+func TestAddAndRemoveImageCopy(t *testing.T) {
+	db := openTestDB(t)
+	store := &DiskStorage{Root: t.TempDir()}
+	copies := []SaveImageArg{{MaxWidth: 64, MaxHeight: 64, ImageFit: ImageFitContain, IsDefault: true}}
+
+	image, err := SaveImage(db, store, FolderLayout{}, testJPEG(t), copies, "")
+	if err != nil {
+		t.Fatal("SaveImage: ", err)
+	}
+
+	arg := SaveImageArg{MaxWidth: 32, MaxHeight: 32, ImageFit: ImageFitCover, Type: ImageTypeWEBP}
+	c, err := AddImageCopy(db, store, image.ID, arg)
+	if err != nil {
+		t.Fatal("AddImageCopy: ", err)
+	}
+	name := imageFilePath(image.Folder, c.Filename(image.ID.String()))
+	if _, err = store.Stat(name); err != nil {
+		t.Fatalf("Stat of added copy: %v", err)
+	}
+
+	image, err = RemoveImageCopy(db, store, image.ID, ImageSize{32, 32}, ImageFitCover, "")
+	if err != nil {
+		t.Fatal("RemoveImageCopy: ", err)
+	}
+	if len(image.Copies) != 0 {
+		t.Fatalf("want no copies after removal, got %v", image.Copies)
+	}
+	if _, err = store.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("Stat of removed copy: want not exist error, got %v", err)
+	}
+
+	if _, err = RemoveImageCopy(db, store, image.ID, ImageSize{32, 32}, ImageFitCover, ""); err != ErrCopyNotFound {
+		t.Fatalf("RemoveImageCopy of missing copy: want ErrCopyNotFound, got %v", err)
+	}
+}
+
+func TestRestoreImage(t *testing.T) {
+	db := openTestDB(t)
+	store := &DiskStorage{Root: t.TempDir()}
+	deleted := &DiskStorage{Root: t.TempDir()}
+	copies := []SaveImageArg{
+		{MaxWidth: 64, MaxHeight: 64, ImageFit: ImageFitContain, IsDefault: true},
+		{MaxWidth: 16, MaxHeight: 16, ImageFit: ImageFitCover},
+	}
+
+	image, err := SaveImage(db, store, FolderLayout{}, testJPEG(t), copies, "")
+	if err != nil {
+		t.Fatal("SaveImage: ", err)
+	}
+	if _, err = DeleteImage(db, image.ID, store, deleted); err != nil {
+		t.Fatal("DeleteImage: ", err)
+	}
+
+	// Concurrent restores must all succeed and leave one set of files.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if restored, err := RestoreImage(db, image.ID, store, deleted); err != nil {
+				errs <- err
+			} else if restored.IsDeleted {
+				errs <- errors.New("image still deleted")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal("RestoreImage: ", err)
+	}
+	if list := listFiles(t, store.Root); len(list) != 2 {
+		t.Fatalf("want the default image and its copy, got %v", list)
+	}
+
+	// A restored image is not purged.
+	if err = purgeImage(db, deleted, image); err != nil {
+		t.Fatal("purgeImage: ", err)
+	}
+	if image, err = GetImage(db, image.ID); err != nil || image.PurgedAt != nil {
+		t.Fatalf("want restored image not purged, got %+v (error: %v)", image, err)
+	}
+}
@@ -0,0 +1,347 @@
+package citra
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/previnder/citra/pkg/luid"
+)
+
+// Folder strategies.
+const (
+	// Folders are numbered sequentially, and a new folder is started when the
+	// last one is full. The path of a folder is its id, for example "1000".
+	FolderStrategyCount = "count"
+
+	// The path of the folder of an image is the date (in UTC) on which it was
+	// uploaded, for example "2022/03/14".
+	FolderStrategyDate = "date"
+
+	// The path of the folder of an image is the first two bytes of the SHA-256
+	// hash of its ID, in hex, for example "3f/a0".
+	FolderStrategyHash = "hash"
+)
+
+// ErrInvalidFolderStrategy is returned for an unknown folder strategy.
+var ErrInvalidFolderStrategy = errors.New("invalid folder strategy")
+
+// FolderLayout determines the folders in which images are saved. Every folder,
+// whatever the strategy, has a record in folders table.
+type FolderLayout struct {
+	// One of the folder strategies. If empty, FolderStrategyCount.
+	Strategy string `json:"strategy"`
+
+	// Maximum number of images in a folder, if Strategy is
+	// FolderStrategyCount. If 0, MaxImagesPerFolder.
+	MaxImages int `json:"maxImages"`
+}
+
+// Validate returns ErrInvalidFolderStrategy if l.Strategy is unknown.
+func (l FolderLayout) Validate() error {
+	switch l.Strategy {
+	case "", FolderStrategyCount, FolderStrategyDate, FolderStrategyHash:
+		return nil
+	}
+	return ErrInvalidFolderStrategy
+}
+
+func (l FolderLayout) maxImages() int {
+	if l.MaxImages > 0 {
+		return l.MaxImages
+	}
+	return MaxImagesPerFolder
+}
+
+// folderPath returns the path of the folder of image with ID, or an empty
+// string if the path is not derived from the image (that is, if the strategy
+// is FolderStrategyCount).
+func (l FolderLayout) folderPath(ID luid.ID) string {
+	switch l.Strategy {
+	case FolderStrategyDate:
+		return ID.Time().Format("2006/01/02")
+	case FolderStrategyHash:
+		sum := sha256.Sum256(ID[:])
+		return hex.EncodeToString(sum[:1]) + "/" + hex.EncodeToString(sum[1:2])
+	}
+	return ""
+}
+
+// contains reports whether image with ID, in folder, is where l would put it.
+func (l FolderLayout) contains(folder string, ID luid.ID) bool {
+	if path := l.folderPath(ID); path != "" {
+		return folder == path
+	}
+	_, err := strconv.Atoi(folder)
+	return err == nil
+}
+
+// isFolderPath reports whether s is a well-formed folder path: one to three
+// slash separated parts of lowercase hex digits.
+func isFolderPath(s string) bool {
+	parts := strings.Split(s, "/")
+	if len(parts) > 3 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+		for _, c := range part {
+			if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// reserveFolderSlot reserves a place for image with ID in the folder l puts it
+// in, creating the folder if necessary, and returns the folder's id and path.
+// The reservation is made by incrementing images_count of the folder in a
+// single statement, so that concurrent callers never overfill a folder. If the
+// image is not saved after all, releaseFolderSlot must be called.
+func reserveFolderSlot(db *sql.DB, l FolderLayout, ID luid.ID) (int, string, error) {
+	if path := l.folderPath(ID); path != "" {
+		// The folder usually exists. It is looked up first because every
+		// insert, even one that updates an existing row, uses up an id.
+		var folderID int
+		err := db.QueryRow("select id from folders where path = ?", path).Scan(&folderID)
+		if err == nil {
+			_, err = db.Exec("update folders set images_count = images_count + 1 where id = ?", folderID)
+			if err != nil {
+				return 0, "", err
+			}
+			return folderID, path, nil
+		}
+		if err != sql.ErrNoRows {
+			return 0, "", err
+		}
+
+		res, err := db.Exec(`insert into folders (path, images_count) values (?, 1)
+			on duplicate key update id = last_insert_id(id), images_count = images_count + 1`, path)
+		if err != nil {
+			return 0, "", err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, "", err
+		}
+		return int(id), path, nil
+	}
+
+	for i := 0; i < 10; i++ {
+		var folderID int
+		err := db.QueryRow("select id from folders where path is null order by id desc limit 1").Scan(&folderID)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, "", err
+		}
+
+		if err == nil {
+			res, err := db.Exec("update folders set images_count = images_count + 1 where id = ? and images_count < ?",
+				folderID, l.maxImages())
+			if err != nil {
+				return 0, "", err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return 0, "", err
+			} else if n == 1 {
+				return folderID, strconv.Itoa(folderID), nil
+			}
+		}
+
+		// The folder is full (or there are none). Only one of concurrent
+		// callers succeeds in creating the next folder; the others try again
+		// to reserve a place in it.
+		var maxID sql.NullInt64
+		if err = db.QueryRow("select max(id) from folders").Scan(&maxID); err != nil {
+			return 0, "", err
+		}
+		folderID = FirstFolderID
+		if maxID.Valid {
+			folderID = int(maxID.Int64) + 1
+		}
+		res, err := db.Exec("insert ignore into folders (id, images_count) values (?, 1)", folderID)
+		if err != nil {
+			return 0, "", err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return 0, "", err
+		} else if n == 1 {
+			return folderID, strconv.Itoa(folderID), nil
+		}
+	}
+	return 0, "", errors.New("could not reserve a place in a folder")
+}
+
+// releaseFolderSlot releases a place reserved by reserveFolderSlot.
+func releaseFolderSlot(db *sql.DB, folderID int) error {
+	_, err := db.Exec("update folders set images_count = images_count - 1 where id = ?", folderID)
+	return err
+}
+
+// moveBatchSize is the number of images fetched from DB at a time while moving
+// images.
+const moveBatchSize = 100
+
+// MoveImages moves all images that are not purged, and that are not where l
+// would put them, to the folders of l. Files of an image are copied to the new
+// folder before the image record is updated, and deleted from the old folder
+// afterwards, so that the image can be served throughout. URLs of moved images
+// change. It returns the number of images moved and the number of images that
+// could not be moved. Errors with individual images are logged and skipped.
+func MoveImages(db *sql.DB, store Storage, l FolderLayout) (moved, failed int, err error) {
+	var cursor luid.ID
+	for {
+		rows, err := db.Query(`select id from images where purged_at is null and id > ? order by id limit ?`,
+			cursor, moveBatchSize)
+		if err != nil {
+			return moved, failed, err
+		}
+
+		var IDs []luid.ID
+		for rows.Next() {
+			var ID luid.ID
+			if err = rows.Scan(&ID); err != nil {
+				rows.Close()
+				return moved, failed, err
+			}
+			IDs = append(IDs, ID)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return moved, failed, err
+		}
+
+		if len(IDs) == 0 {
+			return moved, failed, nil
+		}
+
+		for _, ID := range IDs {
+			image, err := GetImage(db, ID)
+			if err != nil {
+				log.Println("Error moving image", ID, ":", err)
+				failed++
+				continue
+			}
+			if l.contains(image.Folder, ID) {
+				continue
+			}
+			if err = moveImage(db, store, l, image); err != nil {
+				log.Println("Error moving image", ID, ":", err)
+				failed++
+				continue
+			}
+			moved++
+		}
+		cursor = IDs[len(IDs)-1]
+	}
+}
+
+func moveImage(db *sql.DB, store Storage, l FolderLayout, image *DBImage) error {
+	folderID, folder, err := reserveFolderSlot(db, l, image.ID)
+	if err != nil {
+		return err
+	}
+
+	// Deleted images have no files in store.
+	var names []string
+	if !image.IsDeleted {
+		names = append(names, image.ID.String()+image.Type.Extension())
+		for _, c := range image.Copies {
+			names = append(names, c.Filename(image.ID.String()))
+		}
+	}
+
+	var copied []string
+	fail := func(err error) error {
+		for _, name := range copied {
+			store.Delete(imageFilePath(folder, name))
+		}
+		releaseFolderSlot(db, folderID)
+		return err
+	}
+
+	for _, name := range names {
+		data, err := ReadFile(store, imageFilePath(image.Folder, name))
+		if err != nil {
+			return fail(err)
+		}
+		copied = append(copied, name)
+		if err = store.Put(imageFilePath(folder, name), data); err != nil {
+			return fail(err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fail(err)
+	}
+
+	// The image is locked so that no copy is added or removed, in the old
+	// folder, until it is moved.
+	var currentFolderID int
+	var isDeleted bool
+	var copiesJSON []byte
+	row := tx.QueryRow("select folder_id, is_deleted, copies from images where id = ? for update", image.ID)
+	if err = row.Scan(&currentFolderID, &isDeleted, &copiesJSON); err != nil {
+		tx.Rollback()
+		return fail(err)
+	}
+	var copies []*ImageCopy
+	if err = json.Unmarshal(copiesJSON, &copies); err != nil {
+		tx.Rollback()
+		return fail(errors.New("error unmarshaling copies: " + err.Error()))
+	}
+	if currentFolderID != image.FolderID || isDeleted != image.IsDeleted || !sameCopies(copies, image.Copies) {
+		tx.Rollback()
+		return fail(errors.New("image was changed concurrently"))
+	}
+
+	if _, err = tx.Exec("update images set folder_id = ? where id = ?", folderID, image.ID); err != nil {
+		tx.Rollback()
+		return fail(err)
+	}
+
+	if _, err = tx.Exec("update folders set total_size = total_size + ? where id = ?", image.Size, folderID); err != nil {
+		tx.Rollback()
+		return fail(err)
+	}
+
+	_, err = tx.Exec("update folders set images_count = images_count - 1, total_size = total_size - ? where id = ?",
+		image.Size, image.FolderID)
+	if err != nil {
+		tx.Rollback()
+		return fail(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	for _, name := range names {
+		if err = store.Delete(imageFilePath(image.Folder, name)); err != nil && !os.IsNotExist(err) {
+			log.Println("Error deleting moved file:", err)
+		}
+	}
+	return nil
+}
+
+// sameCopies reports whether a and b are the same copies, in the same order.
+func sameCopies(a, b []*ImageCopy) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package citra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/previnder/citra/pkg/luid"
+)
+
+func TestFolderLayout(t *testing.T) {
+	ID, _ := luid.New()
+	date := ID.Time().Format("2006/01/02")
+
+	list := []struct {
+		layout   FolderLayout
+		folder   string
+		contains bool
+	}{
+		{FolderLayout{}, "1000", true},
+		{FolderLayout{Strategy: FolderStrategyCount}, date, false},
+		{FolderLayout{Strategy: FolderStrategyDate}, date, true},
+		{FolderLayout{Strategy: FolderStrategyDate}, "1000", false},
+		{FolderLayout{Strategy: FolderStrategyHash}, date, false},
+	}
+	for _, item := range list {
+		if got := item.layout.contains(item.folder, ID); got != item.contains {
+			t.Fatalf("%+v contains(%v): want %v, got %v", item.layout, item.folder, item.contains, got)
+		}
+	}
+
+	if d := time.Since(ID.Time()); d < 0 || d > time.Minute {
+		t.Fatalf("ID.Time(): got %v, %v ago", ID.Time(), d)
+	}
+
+	path := FolderLayout{Strategy: FolderStrategyHash}.folderPath(ID)
+	if len(path) != 5 || !isFolderPath(path) {
+		t.Fatalf("hash folder path: got %q", path)
+	}
+
+	if err := (FolderLayout{Strategy: "foo"}).Validate(); err != ErrInvalidFolderStrategy {
+		t.Fatalf("Validate: want ErrInvalidFolderStrategy, got %v", err)
+	}
+}
+
+func TestIsFolderPath(t *testing.T) {
+	list := []struct {
+		path string
+		ok   bool
+	}{
+		{"1000", true},
+		{"2022/03/14", true},
+		{"3f/a0", true},
+		{"", false},
+		{"..", false},
+		{"1000/../etc", false},
+		{"2022//14", false},
+		{"1/2/3/4", false},
+	}
+	for _, item := range list {
+		if got := isFolderPath(item.path); got != item.ok {
+			t.Fatalf("isFolderPath(%q): want %v, got %v", item.path, item.ok, got)
+		}
+	}
+}
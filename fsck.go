@@ -0,0 +1,323 @@
+package citra
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+)
+
+// FsckProblemKind is a kind of inconsistency between DB and storage.
+type FsckProblemKind string
+
+// Kinds of problems found by Fsck.
+const (
+	// A file in a folder that belongs to no image, or to a deleted image.
+	FsckOrphanFile = FsckProblemKind("orphan-file")
+
+	// The default image of a non-deleted image is missing. It cannot be
+	// repaired.
+	FsckMissingOriginal = FsckProblemKind("missing-original")
+
+	// A copy of a non-deleted image is missing.
+	FsckMissingCopy = FsckProblemKind("missing-copy")
+
+	// images_count or total_size of a folder do not match its images.
+	FsckWrongFolderCount = FsckProblemKind("wrong-folder-count")
+)
+
+// FsckProblem is an inconsistency found by Fsck.
+type FsckProblem struct {
+	Kind     FsckProblemKind
+	FolderID int
+
+	// Path of the folder.
+	Folder string
+
+	// Name of the file in storage, if the problem concerns a file.
+	Name string
+
+	Detail string
+
+	// True if the problem was repaired.
+	Repaired bool
+
+	// Set if repairing the problem failed.
+	RepairError error
+}
+
+// ErrServerRunning is returned by Fsck when asked to repair while a server is
+// running on the same DB.
+var ErrServerRunning = errors.New("a server is running on the DB")
+
+var errTooManyServers = errors.New("all server locks are held (too many servers running, or fsck is repairing)")
+
+// serverLockSlots is the number of servers that can run at once on the same
+// DB. Every running server holds one of the server locks, and Fsck holds all
+// of them while repairing, so that repairs and servers exclude each other
+// whatever address or config each server uses.
+const serverLockSlots = 32
+
+func serverLockName(slot int) string {
+	return "citra_server_" + strconv.Itoa(slot)
+}
+
+// getLock takes the named lock on conn without waiting, returning false if it
+// is held by another connection. The lock is held until released or until
+// conn is closed.
+func getLock(conn *sql.Conn, name string) (bool, error) {
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(context.Background(), "select get_lock(?, 0)", name).Scan(&got); err != nil {
+		return false, err
+	}
+	if !got.Valid {
+		return false, errors.New("error taking lock " + name)
+	}
+	return got.Int64 == 1, nil
+}
+
+// lockServer takes a free server lock on a new connection of db. The lock is
+// released when the returned connection is closed.
+func lockServer(db *sql.DB) (*sql.Conn, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for slot := 0; slot < serverLockSlots; slot++ {
+		got, err := getLock(conn, serverLockName(slot))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if got {
+			return conn, nil
+		}
+	}
+	conn.Close()
+	return nil, errTooManyServers
+}
+
+// lockRepair takes all the server locks on a new connection of db, returning
+// ErrServerRunning if a server holds one of them. The locks are released when
+// the returned connection is closed.
+func lockRepair(db *sql.DB) (*sql.Conn, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for slot := 0; slot < serverLockSlots; slot++ {
+		got, err := getLock(conn, serverLockName(slot))
+		if err == nil && !got {
+			err = ErrServerRunning
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Fsck compares every folder in folders table with the files in store and
+// returns the problems found. If repair is true, orphan files are deleted,
+// missing copies are regenerated from the default image, and folder counts are
+// corrected.
+//
+// Files modified within grace of now are not reported as orphans, as they may
+// belong to images being saved (including files staged under temporary
+// names). Folder counts include places reserved for images being saved, so
+// they can only be repaired correctly while no image is being saved: repairing
+// returns ErrServerRunning if a server started with Start is running on db.
+// Images saved by other programs using this package are not detected, which
+// the grace period still protects against.
+func Fsck(db *sql.DB, store Storage, repair bool, grace time.Duration) ([]*FsckProblem, error) {
+	if repair {
+		conn, err := lockRepair(db)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+	}
+
+	rows, err := db.Query("select id, coalesce(path, id), images_count, total_size from folders order by id")
+	if err != nil {
+		return nil, err
+	}
+	type folder struct {
+		ID, imagesCount int
+		path            string
+		totalSize       int64
+	}
+	var folders []folder
+	for rows.Next() {
+		var f folder
+		if err = rows.Scan(&f.ID, &f.path, &f.imagesCount, &f.totalSize); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		folders = append(folders, f)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var problems []*FsckProblem
+	for _, f := range folders {
+		p, err := fsckFolder(db, store, f.ID, f.path, f.imagesCount, f.totalSize, repair, grace)
+		if err != nil {
+			return problems, errors.New("folder " + strconv.Itoa(f.ID) + ": " + err.Error())
+		}
+		problems = append(problems, p...)
+	}
+
+	return problems, nil
+}
+
+// fsckImage is the part of a row of images table that Fsck needs.
+type fsckImage struct {
+	image     *DBImage
+	isDeleted bool
+	isPurged  bool
+}
+
+func fsckFolder(db *sql.DB, store Storage, folderID int, folder string, imagesCount int, totalSize int64, repair bool, grace time.Duration) ([]*FsckProblem, error) {
+	rows, err := db.Query(`select id, type, size, copies, is_deleted, purged_at is not null
+		from images where folder_id = ?`, folderID)
+	if err != nil {
+		return nil, err
+	}
+	var images []fsckImage
+	for rows.Next() {
+		var item fsckImage
+		item.image = &DBImage{FolderID: folderID, Folder: folder}
+		var copies []byte
+		if err = rows.Scan(&item.image.ID, &item.image.Type, &item.image.Size, &copies, &item.isDeleted, &item.isPurged); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if len(copies) > 0 {
+			if err = json.Unmarshal(copies, &item.image.Copies); err != nil {
+				rows.Close()
+				return nil, errors.New("error unmarshaling copies: " + err.Error())
+			}
+		}
+		images = append(images, item)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	names, err := store.List(folder + "/")
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool, len(names))
+	for _, name := range names {
+		files[name] = true
+	}
+
+	var problems []*FsckProblem
+	expected := make(map[string]bool)
+	wantCount, wantSize := 0, int64(0)
+	for _, item := range images {
+		image := item.image
+		if !item.isPurged {
+			// Deleted images are only subtracted from folder counts when
+			// purged.
+			wantCount++
+			wantSize += int64(image.Size)
+		}
+		if item.isDeleted {
+			continue
+		}
+
+		original := imageFilePath(folder, image.ID.String()+image.Type.Extension())
+		expected[original] = true
+		if !files[original] {
+			problems = append(problems, &FsckProblem{
+				Kind:     FsckMissingOriginal,
+				FolderID: folderID,
+				Folder:   folder,
+				Name:     original,
+				Detail:   "default image of " + image.ID.String() + " is missing",
+			})
+		}
+
+		for _, c := range image.Copies {
+			name := imageFilePath(folder, c.Filename(image.ID.String()))
+			expected[name] = true
+			if files[name] {
+				continue
+			}
+			p := &FsckProblem{
+				Kind:     FsckMissingCopy,
+				FolderID: folderID,
+				Folder:   folder,
+				Name:     name,
+				Detail:   "copy of " + image.ID.String() + " is missing",
+			}
+			if repair && files[original] {
+				p.RepairError = regenerateCopy(store, image, original, c)
+				p.Repaired = p.RepairError == nil
+			}
+			problems = append(problems, p)
+		}
+	}
+
+	for _, name := range names {
+		if expected[name] {
+			continue
+		}
+		if grace > 0 {
+			info, err := store.Stat(name)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			if time.Since(info.ModTime()) < grace {
+				continue
+			}
+		}
+		p := &FsckProblem{Kind: FsckOrphanFile, FolderID: folderID, Folder: folder, Name: name}
+		if repair {
+			p.RepairError = store.Delete(name)
+			p.Repaired = p.RepairError == nil
+		}
+		problems = append(problems, p)
+	}
+
+	if imagesCount != wantCount || totalSize != wantSize {
+		p := &FsckProblem{
+			Kind:     FsckWrongFolderCount,
+			FolderID: folderID,
+			Folder:   folder,
+			Detail: "images_count " + strconv.Itoa(imagesCount) + " (want " + strconv.Itoa(wantCount) + "), total_size " +
+				strconv.FormatInt(totalSize, 10) + " (want " + strconv.FormatInt(wantSize, 10) + ")",
+		}
+		if repair {
+			_, p.RepairError = db.Exec("update folders set images_count = ?, total_size = ? where id = ?", wantCount, wantSize, folderID)
+			p.Repaired = p.RepairError == nil
+		}
+		problems = append(problems, p)
+	}
+
+	return problems, nil
+}
+
+// regenerateCopy recreates copy c of image from its default image, stored as
+// original.
+func regenerateCopy(store Storage, image *DBImage, original string, c *ImageCopy) error {
+	buf, err := ReadFile(store, original)
+	if err != nil {
+		return err
+	}
+	_, err = saveImageCopy(store, buf, c, image.Folder, image.ID.String())
+	return err
+}
@@ -1,41 +1,91 @@
 package citra
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/previnder/citra/pkg/luid"
+	"github.com/previnder/citra/pkg/urlsign"
 )
 
 // Server is an HTTP server that processes and serves images.
 type Server struct {
-	db     *sql.DB
-	router *mux.Router
-	config *Config
+	db      *sql.DB
+	router  *mux.Router
+	config  *Config
+	storage Storage
+
+	// May be nil.
+	deletedStorage Storage
+
+	// Pool requests that process images, and upload jobs, run in.
+	pool *Pool
+
+	// Wakes up job runners when a job is created.
+	jobsWake chan struct{}
+
+	// Partial uploads of the tus protocol.
+	uploads *partialUploads
 }
 
-// NewServer returns a new image server.
-func NewServer(db *sql.DB, c *Config) *Server {
+// busyRetryAfter is the value of Retry-After header, in seconds, of responses
+// to requests rejected because the processing pool is full.
+const busyRetryAfter = "5"
+
+// NewServer returns a new image server that stores images in store and deleted
+// images in deleted. If deleted is nil, deleted images are not kept.
+func NewServer(db *sql.DB, c *Config, store, deleted Storage) *Server {
 	s := &Server{}
 	s.db = db
 	s.config = c
+	s.storage = store
+	s.deletedStorage = deleted
+
+	concurrency := c.MaxConcurrentProcessing
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	queueDepth := c.ProcessingQueueDepth
+	if queueDepth <= 0 {
+		queueDepth = 4 * concurrency
+	}
+	s.pool = NewPool(concurrency, queueDepth)
+	s.jobsWake = make(chan struct{}, 1)
+	s.uploads = newPartialUploads(db, store, c.TempDir)
 
 	s.router = mux.NewRouter()
 
-	s.router.Handle("/api/images", http.HandlerFunc(s.addImage)).Methods("POST")
-	s.router.Handle("/api/images/_bulk", http.HandlerFunc(s.bulkDelete)).Methods("DELETE")
-	s.router.Handle("/api/images/{imageID}", http.HandlerFunc(s.getImage)).Methods("GET")
-	s.router.Handle("/api/images/{imageID}", http.HandlerFunc(s.deleteImage)).Methods("DELETE")
+	s.router.Handle("/api/images", s.withScope(ScopeUpload, s.addImage)).Methods("POST", "PUT")
+	s.router.Handle("/api/images", s.withScope(ScopeReadMetadata, s.getImages)).Methods("GET")
+	s.router.Handle("/api/images/_bulk", s.withScope(ScopeDelete, s.bulkDelete)).Methods("DELETE")
+	s.router.Handle("/api/images/{imageID}", s.withScope(ScopeReadMetadata, s.getImage)).Methods("GET")
+	s.router.Handle("/api/images/{imageID}", s.withScope(ScopeDelete, s.deleteImage)).Methods("DELETE")
+	s.router.Handle("/api/images/{imageID}/restore", s.withScope(ScopeDelete, s.restoreImage)).Methods("POST")
+	s.router.Handle("/api/images/{imageID}/copies", s.withScope(ScopeUpload, s.addImageCopies)).Methods("POST")
+	s.router.Handle("/api/images/{imageID}/copies", s.withScope(ScopeDelete, s.removeImageCopy)).Methods("DELETE")
+	s.router.Handle("/api/images/{imageID}/similar", s.withScope(ScopeReadMetadata, s.getSimilarImages)).Methods("GET")
+	s.router.HandleFunc("/api/uploads", s.tusOptions).Methods("OPTIONS")
+	s.router.Handle("/api/uploads", s.withScope(ScopeUpload, s.withTus(s.createUpload))).Methods("POST")
+	s.router.Handle("/api/uploads/{uploadID}", s.withScope(ScopeUpload, s.withTus(s.getUpload))).Methods("HEAD")
+	s.router.Handle("/api/uploads/{uploadID}", s.withScope(ScopeUpload, s.withTus(s.patchUpload))).Methods("PATCH")
+	s.router.Handle("/api/uploads/{uploadID}", s.withScope(ScopeUpload, s.withTus(s.deleteUpload))).Methods("DELETE")
+	s.router.Handle("/api/metrics", s.withScope(ScopeReadMetadata, s.getMetrics)).Methods("GET")
 
 	s.router.NotFoundHandler = http.HandlerFunc(s.notFoundHandler)
 	s.router.MethodNotAllowedHandler = http.HandlerFunc(s.methodNotAllowedHandler)
@@ -43,6 +93,42 @@ func NewServer(db *sql.DB, c *Config) *Server {
 	return s
 }
 
+// Start starts the background work of s in new goroutines: running the jobs of
+// asynchronous uploads, purging expired deleted images (if PurgeInBackground
+// is set), and removing expired partial uploads. The work stops once ctx is
+// done. Without Start, asynchronous uploads are accepted but never saved.
+//
+// Start also takes a DB lock, held until ctx is done (or the connection holding
+// it is lost), which keeps fsck from repairing while the server runs.
+func (s *Server) Start(ctx context.Context) error {
+	conn, err := lockServer(s.db)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// Jobs abandoned by a server that stopped are run again once their
+	// heartbeat is stale.
+	runner := newJobRunnerID()
+	for i := 0; i < s.pool.Stats().Concurrency; i++ {
+		go runJobs(ctx, s.db, s.storage, s.config.Folders, s.pool, runner, s.jobsWake, time.Second)
+	}
+
+	if s.config.PurgeInBackground && s.config.DeletedRetentionDays > 0 {
+		retention := time.Duration(s.config.DeletedRetentionDays) * 24 * time.Hour
+		go purgeDeletedImagesEvery(ctx, s.db, s.deletedStorage, retention, time.Hour)
+	}
+
+	if s.config.PartialUploadExpiryHours > 0 {
+		maxAge := time.Duration(s.config.PartialUploadExpiryHours) * time.Hour
+		go expirePartialUploadsEvery(ctx, s.uploads, maxAge, 10*time.Minute)
+	}
+	return nil
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(r.URL.Path, "/api/") {
 		w.Header().Add("Content-Type", "application/json; charset=UTF-8")
@@ -72,6 +158,13 @@ func (s *Server) writeInternalServerError(w http.ResponseWriter, err error) {
 	// debug.PrintStack()
 }
 
+// writeBusy responds that the request cannot be served because the processing
+// pool is full.
+func (s *Server) writeBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", busyRetryAfter)
+	s.writeError(w, http.StatusServiceUnavailable, "Too many images are being processed, try again later")
+}
+
 func (s *Server) notFoundHandler(w http.ResponseWriter, r *http.Request) {
 	s.writeError(w, http.StatusNotFound, "Not found")
 }
@@ -80,6 +173,37 @@ func (s *Server) methodNotAllowedHandler(w http.ResponseWriter, r *http.Request)
 	s.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 }
 
+// withScope returns a handler that calls next only if the request is
+// authenticated with an API key, sent as a Bearer token, that has scope.
+func (s *Server) withScope(scope Scope, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			s.writeError(w, http.StatusUnauthorized, "Missing API key")
+			return
+		}
+
+		key, err := AuthenticateAPIKey(s.db, strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			if err == ErrInvalidAPIKey {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				s.writeError(w, http.StatusUnauthorized, "Invalid API key")
+				return
+			}
+			s.writeInternalServerError(w, err)
+			return
+		}
+
+		if !key.HasScope(scope) {
+			s.writeError(w, http.StatusForbidden, "API key lacks the "+string(scope)+" scope")
+			return
+		}
+
+		next(w, r)
+	})
+}
+
 // abort if error is non-nil.
 //
 // If an error is encounted notFoundHandler is invoked.
@@ -93,77 +217,546 @@ func (s *Server) unmarshalLUID(w http.ResponseWriter, r *http.Request, ID string
 	return LUID, nil
 }
 
-// addImage accepts only POST requests and must have a content type of
-// multipart/form-data.
+// addImage saves an uploaded image. The upload is in one of three forms,
+// depending on the content type of the request:
+//
+//   - multipart/form-data: the image is in field image, and the other
+//     parameters of uploadRequest are form values.
+//   - image/*: the body is the image, and the other parameters are query
+//     parameters. This is meant for PUT requests.
+//   - application/json: the body is an uploadRequest, with the image encoded
+//     in base64.
+//
+// Copies are given either in parameter copies, as JSON, or by the name of a
+// preset in parameter preset.
 func (s *Server) addImage(w http.ResponseWriter, r *http.Request) {
-	r.Body = http.MaxBytesReader(w, r.Body, int64(s.config.MaxUploadSize)) // limit max upload size
-	if err := r.ParseMultipartForm(int64(s.config.MaxUploadSize)); err != nil {
-		if strings.Contains(err.Error(), "request body too large") {
+	maxSize := int64(s.config.MaxUploadSize)
+	var req *uploadRequest
+	var err error
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "multipart/form-data":
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize+maxFormValueSize) // limit max upload size
+		var mr *multipart.Reader
+		if mr, err = r.MultipartReader(); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Error parsing multipart/form-data: "+err.Error())
+			return
+		}
+		// The image is streamed to a temporary file instead of being read
+		// into memory.
+		var upload *tempUpload
+		var form url.Values
+		if upload, form, err = readMultipartUpload(mr, s.config.TempDir, maxSize); err == nil {
+			if upload != nil {
+				defer upload.Close()
+			}
+			req, err = uploadRequestFromValues(form)
+			if err == nil && upload != nil {
+				req.Image = upload.Bytes()
+			}
+		}
+	case strings.HasPrefix(mediaType, "image/"):
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		var upload *tempUpload
+		if upload, err = newTempUpload(r.Body, s.config.TempDir, maxSize); err == nil {
+			defer upload.Close()
+			req, err = uploadRequestFromValues(r.URL.Query())
+			if err == nil {
+				req.Image = upload.Bytes()
+			}
+		}
+	case mediaType == "application/json":
+		// Base64 takes 4 bytes for every 3.
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize/3*4+4+maxFormValueSize)
+		var upload *tempUpload
+		if upload, req, err = readJSONUpload(r.Body, s.config.TempDir, maxSize); err == nil && upload != nil {
+			defer upload.Close()
+		}
+	default:
+		s.writeError(w, http.StatusUnsupportedMediaType, "Content type must be multipart/form-data, image/*, or application/json")
+		return
+	}
+
+	if err != nil {
+		switch err {
+		case ErrUploadTooLarge:
 			s.writeError(w, http.StatusRequestEntityTooLarge, "Upload exceeds the maximum size of "+strconv.Itoa(s.config.MaxUploadSize)+" bytes")
-		} else {
-			s.writeError(w, http.StatusInternalServerError, "Error parsing multipart/form-data: "+err.Error())
+		case errInvalidUploadJSON:
+			s.writeError(w, http.StatusBadRequest, "invalid json")
+		default:
+			s.writeError(w, http.StatusBadRequest, "Error reading upload: "+err.Error())
 		}
 		return
 	}
 
-	file, _, err := r.FormFile("image")
+	s.saveUpload(w, req)
+}
+
+// saveUpload saves the upload req, either right away or, if req.Async, in the
+// background, and writes the response.
+func (s *Server) saveUpload(w http.ResponseWriter, req *uploadRequest) {
+	args, err := s.config.uploadCopies(req)
 	if err != nil {
-		s.writeInternalServerError(w, err)
+		s.writeUploadCopiesError(w, err)
+		return
+	}
+
+	if req.Async {
+		s.addImageAsync(w, req.Image, args, req.Preset)
 		return
 	}
-	defer file.Close()
 
-	buf, err := ioutil.ReadAll(file)
+	t1 := time.Now()
+
+	var image *DBImage
+	err = s.pool.Do(func() (err error) {
+		image, err = SaveImage(s.db, s.storage, s.config.Folders, req.Image, args, req.Preset)
+		return
+	})
 	if err != nil {
-		s.writeInternalServerError(w, err)
+		s.writeSaveImageError(w, err)
 		return
 	}
 
-	copies := r.Form.Get("copies")
-	if copies == "" {
+	log.Printf("Took %v to process %v\n", time.Since(t1), image.ID)
+
+	image.GenerateURLs(s.config.URLSecret)
+	data, _ := json.Marshal(image)
+	w.Write(data)
+}
+
+// writeUploadCopiesError writes the response to an upload whose copies are
+// invalid, as returned by Config.uploadCopies.
+func (s *Server) writeUploadCopiesError(w http.ResponseWriter, err error) {
+	switch err {
+	case errCopiesAndPreset:
+		s.writeError(w, http.StatusBadRequest, "Only one of copies and preset may be given")
+	case errUnknownPreset:
+		s.writeError(w, http.StatusBadRequest, "Unknown preset")
+	default:
 		s.writeError(w, http.StatusBadRequest, "no copies to make")
+	}
+}
+
+// writeSaveImageError writes the response to an upload that failed to be
+// saved with err.
+func (s *Server) writeSaveImageError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNoDefaultImage:
+		s.writeError(w, http.StatusBadRequest, "No default copy to make")
+	case ErrUnsupportedImage:
+		s.writeError(w, http.StatusBadRequest, "Unsupported image format")
+	case ErrNoImage:
+		s.writeError(w, http.StatusBadRequest, "Image buffer empty")
+	case ErrBusy:
+		s.writeBusy(w)
+	default:
+		s.writeInternalServerError(w, err)
+	}
+}
+
+// addImageAsync creates a job that saves the upload in the background and
+// responds with 202 Accepted and the job. The status of the job is reported
+// by getImage until the image is saved.
+func (s *Server) addImageAsync(w http.ResponseWriter, buf []byte, args []SaveImageArg, preset string) {
+	job, err := CreateJob(s.db, s.storage, buf, args, preset)
+	if err != nil {
+		s.writeSaveImageError(w, err)
 		return
 	}
 
-	var args []SaveImageArg
-	if err = json.Unmarshal([]byte(copies), &args); err != nil {
+	select {
+	case s.jobsWake <- struct{}{}:
+	default:
+	}
+
+	w.Header().Set("Location", "/api/images/"+job.ID.String())
+	w.WriteHeader(http.StatusAccepted)
+	data, _ := json.Marshal(job)
+	w.Write(data)
+}
+
+// withTus returns a handler that calls next only if the request is made with
+// the version of the tus protocol supported.
+func (s *Server) withTus(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			s.writeError(w, http.StatusPreconditionFailed, "Unsupported tus version")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// tusOptions responds with the capabilities of the tus server.
+func (s *Server) tusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(s.config.MaxUploadSize))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setUploadExpires sets header Upload-Expires of a response about u.
+func (s *Server) setUploadExpires(w http.ResponseWriter, u *partialUpload) {
+	if s.config.PartialUploadExpiryHours > 0 {
+		expires := u.UpdatedAt.Add(time.Duration(s.config.PartialUploadExpiryHours) * time.Hour)
+		w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+// createUpload creates a partial upload of the tus protocol. Its parameters,
+// those of addImage, are given in header Upload-Metadata.
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		s.writeError(w, http.StatusBadRequest, "Invalid Upload-Length header")
+		return
+	}
+	if length == 0 {
+		s.writeSaveImageError(w, ErrNoImage)
+		return
+	}
+	if length > int64(s.config.MaxUploadSize) {
+		s.writeError(w, http.StatusRequestEntityTooLarge, "Upload exceeds the maximum size of "+strconv.Itoa(s.config.MaxUploadSize)+" bytes")
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid Upload-Metadata header")
+		return
+	}
+	req, err := uploadRequestFromValues(metadata)
+	if err != nil {
 		s.writeError(w, http.StatusBadRequest, "invalid json")
 		return
 	}
 
-	t1 := time.Now()
+	// Copies are checked now rather than after the whole upload is received.
+	args, err := s.config.uploadCopies(req)
+	if err != nil {
+		s.writeUploadCopiesError(w, err)
+		return
+	}
+	hasDefault := false
+	for _, item := range args {
+		hasDefault = hasDefault || item.IsDefault
+	}
+	if !hasDefault {
+		s.writeSaveImageError(w, ErrNoDefaultImage)
+		return
+	}
+
+	u, err := s.uploads.create(length, *req)
+	if err != nil {
+		s.writeInternalServerError(w, err)
+		return
+	}
+
+	s.setUploadExpires(w, u)
+	w.Header().Set("Location", "/api/uploads/"+u.ID.String())
+	w.WriteHeader(http.StatusCreated)
+}
 
-	image, err := SaveImage(s.db, buf, args, s.config.RootUploadsDir)
+// lockUpload locks the partial upload with ID and returns the token with which
+// it is unlocked. If it cannot be locked, the response is written and false is
+// returned.
+func (s *Server) lockUpload(w http.ResponseWriter, r *http.Request, ID luid.ID) (string, bool) {
+	token, err := s.uploads.lock(ID)
 	if err != nil {
-		if err == ErrNoDefaultImage {
-			s.writeError(w, http.StatusBadRequest, "No default copy to make")
+		switch {
+		case err == errUploadLocked:
+			s.writeError(w, http.StatusConflict, "Upload is being written by another request")
+		case os.IsNotExist(err):
+			s.notFoundHandler(w, r)
+		default:
+			s.writeInternalServerError(w, err)
+		}
+		return "", false
+	}
+	return token, true
+}
+
+// getPartialUpload returns the partial upload of the request. If it is not
+// found, notFoundHandler is invoked and nil is returned.
+func (s *Server) getPartialUpload(w http.ResponseWriter, r *http.Request) *partialUpload {
+	uploadID, err := s.unmarshalLUID(w, r, mux.Vars(r)["uploadID"])
+	if err != nil {
+		return nil
+	}
+
+	u, err := s.uploads.get(uploadID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.notFoundHandler(w, r)
+		} else {
+			s.writeInternalServerError(w, err)
+		}
+		return nil
+	}
+	return u
+}
+
+// getUpload responds with the offset and length of a partial upload.
+func (s *Server) getUpload(w http.ResponseWriter, r *http.Request) {
+	u := s.getPartialUpload(w, r)
+	if u == nil {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	s.setUploadExpires(w, u)
+	w.WriteHeader(http.StatusOK)
+}
+
+// patchUpload appends a chunk to a partial upload. Once the upload is
+// complete the image is saved, as by addImage, and the upload is removed. The
+// path of the image, or that of its job if the upload is asynchronous, is
+// given in header Image-Location. If saving fails for a reason that may pass,
+// such as a DB error, the upload is kept, and a PATCH with no data at the end
+// of the upload tries again.
+func (s *Server) patchUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		s.writeError(w, http.StatusUnsupportedMediaType, "Content type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		s.writeError(w, http.StatusBadRequest, "Invalid Upload-Offset header")
+		return
+	}
+
+	uploadID, err := s.unmarshalLUID(w, r, mux.Vars(r)["uploadID"])
+	if err != nil {
+		return
+	}
+	token, ok := s.lockUpload(w, r, uploadID)
+	if !ok {
+		return
+	}
+	defer s.uploads.unlock(uploadID, token)
+
+	u := s.getPartialUpload(w, r)
+	if u == nil {
+		return
+	}
+
+	if err = s.uploads.write(u, token, offset, r.Body); err != nil {
+		if err == errUploadOffset {
+			s.writeError(w, http.StatusConflict, "Upload-Offset does not match the offset of the upload")
+		} else if err == errUploadLocked {
+			s.writeError(w, http.StatusConflict, "Upload is being written by another request")
+		} else {
+			s.writeError(w, http.StatusBadRequest, "Error reading upload: "+err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	if !u.Complete() {
+		s.setUploadExpires(w, u)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// The upload is kept if saving it fails for a reason that may pass, so
+	// that the client can retry the last PATCH without sending the whole
+	// upload again.
+	location, err := s.finishUpload(u)
+	done := false
+	switch err {
+	case nil, ErrUnsupportedImage, ErrNoImage, ErrNoDefaultImage, errCopiesAndPreset, errUnknownPreset, errNoCopies:
+		done = true
+	}
+	if done {
+		if err2 := s.uploads.remove(u.ID); err2 != nil {
+			log.Println("Error removing upload", u.ID, ":", err2)
+		}
+	}
+	if err != nil {
+		switch err {
+		case errCopiesAndPreset, errUnknownPreset, errNoCopies:
+			s.writeUploadCopiesError(w, err)
+		default:
+			s.writeSaveImageError(w, err)
+		}
+		return
+	}
+
+	w.Header().Set("Image-Location", location)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload saves the image of u, which must be complete, and returns its
+// path in the API. If the processing pool is full, or if the upload is
+// asynchronous, a job is created to save the image instead, and the path of
+// the job is returned.
+func (s *Server) finishUpload(u *partialUpload) (string, error) {
+	args, err := s.config.uploadCopies(&u.Request)
+	if err != nil {
+		return "", err
+	}
+
+	var ID luid.ID
+	err = s.uploads.read(u, func(buf []byte) error {
+		if !u.Request.Async {
+			var image *DBImage
+			err := s.pool.Do(func() (err error) {
+				image, err = SaveImage(s.db, s.storage, s.config.Folders, buf, args, u.Request.Preset)
+				return
+			})
+			if err != ErrBusy {
+				if err == nil {
+					ID = image.ID
+				}
+				return err
+			}
+		}
+
+		job, err := CreateJob(s.db, s.storage, buf, args, u.Request.Preset)
+		if err != nil {
+			return err
+		}
+		select {
+		case s.jobsWake <- struct{}{}:
+		default:
+		}
+		ID = job.ID
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "/api/images/" + ID.String(), nil
+}
+
+// deleteUpload removes a partial upload.
+func (s *Server) deleteUpload(w http.ResponseWriter, r *http.Request) {
+	uploadID, err := s.unmarshalLUID(w, r, mux.Vars(r)["uploadID"])
+	if err != nil {
+		return
+	}
+	if _, ok := s.lockUpload(w, r, uploadID); !ok {
+		return
+	}
+
+	if err = s.uploads.remove(uploadID); err != nil {
+		if os.IsNotExist(err) {
+			s.notFoundHandler(w, r)
+		} else {
+			s.writeInternalServerError(w, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getImage returns an image. If the image was uploaded asynchronously and is
+// not saved yet, its job is returned instead, with the status of the job. If
+// the upload was deduplicated into another image, that image is returned.
+func (s *Server) getImage(w http.ResponseWriter, r *http.Request) {
+	imageID, err := s.unmarshalLUID(w, r, mux.Vars(r)["imageID"])
+	if err != nil {
+		return
+	}
+
+	image, err := GetImage(s.db, imageID)
+	if err == sql.ErrNoRows {
+		var job *Job
+		if job, err = GetJob(s.db, imageID); err == nil {
+			if job.Status != JobReady {
+				data, _ := json.Marshal(job)
+				w.Write(data)
+				return
+			}
+			image, err = GetImage(s.db, job.ImageID.ID)
+		}
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			s.notFoundHandler(w, r)
 			return
 		}
-		if err == ErrUnsupportedImage {
-			s.writeError(w, http.StatusBadRequest, "Unsupported image format")
+		s.writeInternalServerError(w, err)
+		return
+	}
+
+	image.GenerateURLs(s.config.URLSecret)
+	data, _ := json.Marshal(image)
+	w.Write(data)
+}
+
+// getImages lists images in the order they were created. Query parameters:
+// after (ID of the last image of the previous page), limit (default 100, at
+// most 1000), deleted (exclude, include, or only), and folder (folder ID).
+func (s *Server) getImages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	arg := GetImagesArg{Limit: 100}
+
+	if after := q.Get("after"); after != "" {
+		if err := arg.After.ID.UnmarshalText([]byte(after)); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Invalid after ID")
 			return
 		}
-		if err == ErrNoImage {
-			s.writeError(w, http.StatusBadRequest, "Image buffer empty")
+		arg.After.Valid = true
+	}
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > 1000 {
+			s.writeError(w, http.StatusBadRequest, "limit must be an integer between 1 and 1000")
 			return
 		}
+		arg.Limit = n
+	}
+	if err := arg.Deleted.UnmarshalText([]byte(q.Get("deleted"))); err != nil {
+		s.writeError(w, http.StatusBadRequest, "deleted must be one of exclude, include, or only")
+		return
+	}
+	if folder := q.Get("folder"); folder != "" {
+		n, err := strconv.Atoi(folder)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "Invalid folder ID")
+			return
+		}
+		arg.FolderID = n
+	}
+
+	images, err := GetImages(s.db, arg)
+	if err != nil {
 		s.writeInternalServerError(w, err)
 		return
 	}
 
-	log.Printf("Took %v to process %v\n", time.Since(t1), image.ID)
+	res := struct {
+		Images []*DBImage `json:"images"`
+		// ID to pass as after to get the next page. Null if this is the last
+		// page.
+		Next luid.NullID `json:"next"`
+	}{Images: images}
+	for _, image := range images {
+		image.GenerateURLs(s.config.URLSecret)
+	}
+	if len(images) == arg.Limit {
+		res.Next = luid.NullID{ID: images[len(images)-1].ID, Valid: true}
+	}
 
-	data, _ := json.Marshal(image)
+	data, _ := json.Marshal(res)
 	w.Write(data)
 }
 
-func (s *Server) getImage(w http.ResponseWriter, r *http.Request) {
+func (s *Server) deleteImage(w http.ResponseWriter, r *http.Request) {
 	imageID, err := s.unmarshalLUID(w, r, mux.Vars(r)["imageID"])
 	if err != nil {
 		return
 	}
 
-	image, err := GetImage(s.db, imageID)
+	image, err := DeleteImage(s.db, imageID, s.storage, s.deletedStorage)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			s.notFoundHandler(w, r)
@@ -173,37 +766,228 @@ func (s *Server) getImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	image.GenerateURLs(s.config.URLSecret)
 	data, _ := json.Marshal(image)
 	w.Write(data)
 }
 
-func (s *Server) deleteImage(w http.ResponseWriter, r *http.Request) {
+func (s *Server) restoreImage(w http.ResponseWriter, r *http.Request) {
 	imageID, err := s.unmarshalLUID(w, r, mux.Vars(r)["imageID"])
 	if err != nil {
 		return
 	}
 
-	image, err := DeleteImage(s.db, imageID, s.config.RootUploadsDir, s.config.DeletedDir)
+	var image *DBImage
+	err = s.pool.Do(func() (err error) {
+		image, err = RestoreImage(s.db, imageID, s.storage, s.deletedStorage)
+		return
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			s.notFoundHandler(w, r)
 			return
 		}
+		if err == ErrImagePurged {
+			s.writeError(w, http.StatusGone, "Image file has already been purged and cannot be restored")
+			return
+		}
+		if err == ErrBusy {
+			s.writeBusy(w)
+			return
+		}
 		s.writeInternalServerError(w, err)
 		return
 	}
 
+	image.GenerateURLs(s.config.URLSecret)
 	data, _ := json.Marshal(image)
 	w.Write(data)
 }
 
-// URL is of the form /images/{folderID/{imageID}.jpg[?size=1440x720&fit=cover]
+// addImageCopies creates copies of an existing image from its default image.
+// The request body is a JSON array of copies to make, in the same format as the
+// copies of an upload (default is ignored). Copies that already exist are left
+// as they are.
+func (s *Server) addImageCopies(w http.ResponseWriter, r *http.Request) {
+	imageID, err := s.unmarshalLUID(w, r, mux.Vars(r)["imageID"])
+	if err != nil {
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Error reading request body")
+		return
+	}
+
+	var args []SaveImageArg
+	if err = json.Unmarshal(data, &args); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Error reading JSON body")
+		return
+	}
+	if len(args) == 0 {
+		s.writeError(w, http.StatusBadRequest, "no copies to make")
+		return
+	}
+	// Fits are checked as the JSON is read. Sizes are checked before any copy
+	// is made, so that an invalid copy fails the request without making the
+	// copies before it.
+	for _, arg := range args {
+		if arg.MaxWidth <= 0 || arg.MaxHeight <= 0 {
+			s.writeError(w, http.StatusBadRequest, "invalid copy size")
+			return
+		}
+	}
+
+	err = s.pool.Do(func() error {
+		for _, arg := range args {
+			arg.IsDefault = false
+			if _, err := AddImageCopy(s.db, s.storage, imageID, arg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			s.notFoundHandler(w, r)
+		case ErrImageDeleted:
+			s.writeError(w, http.StatusConflict, "Image is deleted")
+		case ErrUnsupportedImage:
+			s.writeError(w, http.StatusBadRequest, "Unsupported image format")
+		case ErrBusy:
+			s.writeBusy(w)
+		default:
+			s.writeInternalServerError(w, err)
+		}
+		return
+	}
+
+	image, err := GetImage(s.db, imageID)
+	if err != nil {
+		s.writeInternalServerError(w, err)
+		return
+	}
+
+	image.GenerateURLs(s.config.URLSecret)
+	data, _ = json.Marshal(image)
+	w.Write(data)
+}
+
+// removeImageCopy removes the copies of an image of the size and fit query
+// parameters (fit defaults to contain). If query parameter type is given, only
+// the copy of that type is removed.
+func (s *Server) removeImageCopy(w http.ResponseWriter, r *http.Request) {
+	imageID, err := s.unmarshalLUID(w, r, mux.Vars(r)["imageID"])
+	if err != nil {
+		return
+	}
+
+	q := r.URL.Query()
+	var size ImageSize
+	if err = size.UnmarshalText([]byte(q.Get("size"))); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid size")
+		return
+	}
+	var fit ImageFit
+	if err = fit.UnmarshalText([]byte(q.Get("fit"))); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid fit")
+		return
+	}
+	var t ImageType
+	if q.Get("type") != "" {
+		if err = t.UnmarshalText([]byte(q.Get("type"))); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Invalid type")
+			return
+		}
+	}
+
+	image, err := RemoveImageCopy(s.db, s.storage, imageID, size, fit, t)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows, ErrCopyNotFound:
+			s.notFoundHandler(w, r)
+		case ErrImageDeleted:
+			s.writeError(w, http.StatusConflict, "Image is deleted")
+		default:
+			s.writeInternalServerError(w, err)
+		}
+		return
+	}
+
+	image.GenerateURLs(s.config.URLSecret)
+	data, _ := json.Marshal(image)
+	w.Write(data)
+}
+
+// getMetrics returns statistics of the image processing pool, including the
+// time operations wait in its queue.
+func (s *Server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	res := struct {
+		Processing PoolStats `json:"processing"`
+	}{
+		Processing: s.pool.Stats(),
+	}
+	data, _ := json.Marshal(res)
+	w.Write(data)
+}
+
+// getSimilarImages returns images whose perceptual hashes are within the
+// distance query parameter (default 10) of the image's.
+func (s *Server) getSimilarImages(w http.ResponseWriter, r *http.Request) {
+	imageID, err := s.unmarshalLUID(w, r, mux.Vars(r)["imageID"])
+	if err != nil {
+		return
+	}
+
+	distance := 10
+	if q := r.URL.Query().Get("distance"); q != "" {
+		if distance, err = strconv.Atoi(q); err != nil || distance < 0 || distance > 64 {
+			s.writeError(w, http.StatusBadRequest, "distance must be an integer between 0 and 64")
+			return
+		}
+	}
+
+	images, err := GetSimilarImages(s.db, imageID, distance, 100)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			s.notFoundHandler(w, r)
+			return
+		}
+		s.writeInternalServerError(w, err)
+		return
+	}
+
+	if images == nil {
+		images = []*SimilarImage{}
+	}
+	for _, item := range images {
+		item.Image.GenerateURLs(s.config.URLSecret)
+	}
+	data, _ := json.Marshal(images)
+	w.Write(data)
+}
+
+// URL is of the form
+//
+//	/images/{folder}/{imageID}[.{jpg|webp|avif}][?size=1440x720&fit=cover]
+//
+// where folder is the path of a folder, such as 1000 or 2022/03/14. In place of
+// size and fit, the name of a preset may be given (?preset=avatar), in which
+// case the size, fit, and type of the default copy of the preset are used; see
+// Config.Presets.
+//
+// If the URL has no extension, the type of image served is negotiated using
+// the Accept header of the request. The default image is saved in the type
+// negotiated, as a variant, if it is not already. If Config.URLSecret is set,
+// URLs with a size must also have a valid sig query parameter.
 func (s *Server) serveImages(w http.ResponseWriter, r *http.Request) {
 	path := strings.Split(r.URL.Path, "/")
 	if path[0] == "" {
 		path = path[1:]
 	}
-	if len(path) != 3 {
+	if len(path) < 3 {
 		http.NotFound(w, r)
 		return
 	}
@@ -211,49 +995,169 @@ func (s *Server) serveImages(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	folderID, err := strconv.Atoi(path[1])
-	if err != nil {
+	folder := strings.Join(path[1:len(path)-1], "/")
+	if !isFolderPath(folder) {
 		http.NotFound(w, r)
 		return
 	}
-	if !strings.HasSuffix(path[2], ".jpg") {
-		http.NotFound(w, r)
-		return
+	filename := path[len(path)-1]
+	// Types to try, in order.
+	var types []ImageType
+	negotiated := false
+	ext := filepath.Ext(filename)
+	if ext == "" {
+		types = negotiateImageTypes(r.Header.Get("Accept"))
+		negotiated = true
+	} else {
+		imageType, ok := ImageTypeFromExtension(ext)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		types = []ImageType{imageType}
 	}
 	imageID := luid.ID{}
-	if err = imageID.UnmarshalText([]byte(path[2][:strings.LastIndex(path[2], ".jpg")])); err != nil {
+	err := imageID.UnmarshalText([]byte(strings.TrimSuffix(filename, ext)))
+	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
 
 	q := r.URL.Query()
 	name := imageID.String()
-	if q.Get("size") != "" {
-		var size ImageSize
+	var size ImageSize
+	fit := ImageFitContain
+	preset := q.Get("preset")
+	sized := q.Get("size") != ""
+	if preset != "" {
+		arg, ok := s.config.presetDefault(preset)
+		if !ok || sized {
+			http.NotFound(w, r)
+			return
+		}
+		image, err := GetImage(s.db, imageID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.NotFound(w, r)
+				return
+			}
+			s.imageInternalServerError(w, r, err)
+			return
+		}
+		if image.IsDeleted {
+			http.NotFound(w, r)
+			return
+		}
+
+		// The default image of an image uploaded with the preset is the
+		// default copy of the preset. Otherwise the URL is that of a copy.
+		if image.Preset != preset {
+			if s.config.URLSecret != "" && !urlsign.Verify([]byte(s.config.URLSecret), r.URL.Path, q) {
+				http.Error(w, "Invalid URL signature", http.StatusForbidden)
+				return
+			}
+			size = ImageSize{Width: arg.MaxWidth, Height: arg.MaxHeight}
+			if arg.ImageFit != "" {
+				fit = arg.ImageFit
+			}
+			t := arg.Type
+			if t == "" {
+				t = ImageTypeDefault
+			}
+			if negotiated {
+				types, negotiated = []ImageType{t}, false
+			} else if types[0].Extension() != t.Extension() {
+				http.NotFound(w, r)
+				return
+			}
+			sized = true
+		}
+	} else if sized {
 		if err = size.UnmarshalText([]byte(q.Get("size"))); err != nil {
 			http.NotFound(w, r)
 			return
 		}
-		name += "_" + strconv.Itoa(size.Width) + "_" + strconv.Itoa(size.Height)
-		fit := ImageFitContain
 		if q.Get("fit") != "" {
 			if err = fit.UnmarshalText([]byte(q.Get("fit"))); err != nil {
 				http.NotFound(w, r)
 				return
 			}
 		}
-		name += "_" + string(fit)
+
+		if s.config.URLSecret != "" && !urlsign.Verify([]byte(s.config.URLSecret), r.URL.Path, q) {
+			http.Error(w, "Invalid URL signature", http.StatusForbidden)
+			return
+		}
+	}
+	if sized {
+		name += "_" + strconv.Itoa(size.Width) + "_" + strconv.Itoa(size.Height) + "_" + string(fit)
 	}
 
-	filepath := filepath.Join(s.config.RootUploadsDir, strconv.Itoa(folderID), name+".jpg")
+	if negotiated {
+		w.Header().Add("Vary", "Accept")
+	}
 
-	file, err := os.Open(filepath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			http.NotFound(w, r)
+	var file File
+	var imageType ImageType
+	for _, t := range types {
+		file, err = s.storage.Open(imageFilePath(folder, name+t.Extension()))
+		if err == nil {
+			imageType = t
+			break
+		}
+		if !os.IsNotExist(err) {
+			s.imageInternalServerError(w, r, err)
 			return
 		}
-		s.imageInternalServerError(w, r, err)
+	}
+	if file != nil && !sized && negotiated && imageType != types[0] {
+		// The default image is saved in the type the client prefers, as a
+		// variant, the first time it is requested. If that fails, the type
+		// found is served.
+		err = s.pool.Do(func() error {
+			_, err := AddImageVariant(s.db, s.storage, imageID, types[0])
+			return err
+		})
+		if err == nil {
+			if variant, err := s.storage.Open(imageFilePath(folder, name+types[0].Extension())); err == nil {
+				file.Close()
+				file, imageType = variant, types[0]
+			}
+		} else if err != ErrBusy && err != sql.ErrNoRows && err != ErrImageDeleted {
+			log.Println("Error adding variant of image", imageID, ":", err)
+		}
+	}
+	if file == nil && sized && s.isOnDemandSize(size) {
+		arg := SaveImageArg{MaxWidth: size.Width, MaxHeight: size.Height, ImageFit: fit, Type: types[0]}
+		err = s.pool.Do(func() error {
+			_, err := AddImageCopy(s.db, s.storage, imageID, arg)
+			return err
+		})
+		if err != nil {
+			if err == sql.ErrNoRows || err == ErrImageDeleted {
+				http.NotFound(w, r)
+				return
+			}
+			if err == ErrBusy {
+				w.Header().Set("Retry-After", busyRetryAfter)
+				http.Error(w, "Server busy", http.StatusServiceUnavailable)
+				return
+			}
+			s.imageInternalServerError(w, r, err)
+			return
+		}
+		if file, err = s.storage.Open(imageFilePath(folder, name+arg.Type.Extension())); err != nil {
+			if os.IsNotExist(err) { // folder in URL is incorrect
+				http.NotFound(w, r)
+				return
+			}
+			s.imageInternalServerError(w, r, err)
+			return
+		}
+		imageType = arg.Type
+	}
+	if file == nil {
+		http.NotFound(w, r)
 		return
 	}
 	defer file.Close()
@@ -264,11 +1168,81 @@ func (s *Server) serveImages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("Content-Type", imageType.ContentType())
 	w.Header().Add("Cache-Control", "public, max-age=31536000, immutable")
 	w.Header().Add("Cross-Origin-Resource-Policy", "cross-origin")
 	http.ServeContent(w, r, "", stat.ModTime(), file)
 }
 
+// negotiateImageTypes returns all image types ordered by how preferable they
+// are to a client that sent accept as its Accept header. AVIF and WebP are
+// only preferred over JPEG if the client lists them explicitly, since wildcards
+// are sent by clients that do not support either. Types the client does not
+// accept are still returned, last, so that an image is served even if none of
+// the accepted types are available.
+func negotiateImageTypes(accept string) []ImageType {
+	preferred := []ImageType{ImageTypeAVIF, ImageTypeWEBP}
+	quality := make(map[ImageType]float64)
+	jpegQuality := -1.0 // -1 means not listed explicitly
+	wildcard := 0.0
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		mime := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch mime {
+		case "image/avif":
+			quality[ImageTypeAVIF] = q
+		case "image/webp":
+			quality[ImageTypeWEBP] = q
+		case "image/jpeg":
+			jpegQuality = q
+		case "image/*", "*/*":
+			if q > wildcard {
+				wildcard = q
+			}
+		}
+	}
+	if jpegQuality == -1 {
+		jpegQuality = wildcard
+		if accept == "" {
+			jpegQuality = 1
+		}
+	}
+
+	var types, rest []ImageType
+	for _, t := range preferred {
+		if quality[t] > 0 && quality[t] >= jpegQuality {
+			types = append(types, t)
+		} else {
+			rest = append(rest, t)
+		}
+	}
+	sort.SliceStable(types, func(i, j int) bool {
+		return quality[types[i]] > quality[types[j]]
+	})
+	types = append(types, ImageTypeJPEG)
+	return append(types, rest...)
+}
+
+// isOnDemandSize reports whether copies of size may be generated when they are
+// first requested.
+func (s *Server) isOnDemandSize(size ImageSize) bool {
+	for _, item := range s.config.OnDemandSizes {
+		if item == size {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) imageInternalServerError(w http.ResponseWriter, r *http.Request, err error) {
 	log.Println("500 error:", err)
 	debug.PrintStack()
@@ -290,7 +1264,7 @@ func (s *Server) bulkDelete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, id := range IDs {
-		if _, err = DeleteImage(s.db, id, s.config.RootUploadsDir, s.config.DeletedDir); err != nil {
+		if _, err = DeleteImage(s.db, id, s.storage, s.deletedStorage); err != nil {
 			s.imageInternalServerError(w, r, err)
 			return
 		}
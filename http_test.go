@@ -0,0 +1,72 @@
+package citra
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateImageTypes(t *testing.T) {
+	list := []struct {
+		accept string
+		want   []ImageType
+	}{
+		{"", []ImageType{ImageTypeJPEG, ImageTypeAVIF, ImageTypeWEBP}},
+		{"*/*", []ImageType{ImageTypeJPEG, ImageTypeAVIF, ImageTypeWEBP}},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", []ImageType{ImageTypeAVIF, ImageTypeWEBP, ImageTypeJPEG}},
+		{"image/webp,*/*", []ImageType{ImageTypeWEBP, ImageTypeJPEG, ImageTypeAVIF}},
+		{"image/avif;q=0.5,image/webp;q=0.9,image/*;q=0.4", []ImageType{ImageTypeWEBP, ImageTypeAVIF, ImageTypeJPEG}},
+		{"image/webp;q=0", []ImageType{ImageTypeJPEG, ImageTypeAVIF, ImageTypeWEBP}},
+	}
+
+	for _, item := range list {
+		got := negotiateImageTypes(item.accept)
+		if !reflect.DeepEqual(got, item.want) {
+			t.Fatalf("negotiateImageTypes(%q): want %v, got %v", item.accept, item.want, got)
+		}
+	}
+}
+
+func TestServeDefaultImageNegotiated(t *testing.T) {
+	db := openTestDB(t)
+	store := &DiskStorage{Root: t.TempDir()}
+	copies := []SaveImageArg{{MaxWidth: 64, MaxHeight: 64, ImageFit: ImageFitContain, IsDefault: true}}
+	image, err := SaveImage(db, store, FolderLayout{}, testJPEG(t), copies, "")
+	if err != nil {
+		t.Fatal("SaveImage: ", err)
+	}
+	s := NewServer(db, &Config{}, store, nil)
+
+	list := []struct {
+		accept string
+		want   ImageType
+	}{
+		{"image/avif,image/webp,*/*;q=0.8", ImageTypeAVIF},
+		{"image/avif,image/webp,*/*;q=0.8", ImageTypeAVIF}, // variant saved above
+		{"image/jpeg", ImageTypeJPEG},
+		{"", ImageTypeJPEG},
+	}
+	for _, item := range list {
+		r := httptest.NewRequest("GET", "/images/"+image.Folder+"/"+image.ID.String(), nil)
+		r.Header.Set("Accept", item.accept)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Accept %q: want status 200, got %v", item.accept, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != item.want.ContentType() {
+			t.Fatalf("Accept %q: want %v, got %v", item.accept, item.want.ContentType(), got)
+		}
+		if w.Header().Get("Vary") != "Accept" {
+			t.Fatalf("Accept %q: want Vary: Accept, got %q", item.accept, w.Header().Get("Vary"))
+		}
+	}
+
+	if image, err = GetImage(db, image.ID); err != nil {
+		t.Fatal("GetImage: ", err)
+	}
+	if len(image.Copies) != 1 || !image.Copies[0].isVariantOf(ImageTypeAVIF) {
+		t.Fatalf("want one AVIF variant, got %+v", image.Copies)
+	}
+}
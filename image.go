@@ -1,13 +1,18 @@
 package citra
 
 import (
+	"bytes"
 	"errors"
 	"image"
+	"image/jpeg"
 	"math"
+	"math/bits"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/h2non/bimg"
+	"github.com/previnder/citra/pkg/blurhash"
 )
 
 // ImageType represents the type of image.
@@ -17,11 +22,77 @@ type ImageType string
 const (
 	ImageTypeJPEG = ImageType("jpeg")
 	ImageTypeWEBP = ImageType("webp")
+	ImageTypeAVIF = ImageType("avif")
+
+	ImageTypeDefault = ImageTypeJPEG
 )
 
+// UnmarshalText implements encoding.TextUnmarshaler interface.
+func (t *ImageType) UnmarshalText(text []byte) error {
+	str := string(text)
+	switch str {
+	case string(ImageTypeJPEG), string(ImageTypeWEBP), string(ImageTypeAVIF):
+		*t = ImageType(str)
+		return nil
+	case "":
+		*t = ImageTypeDefault
+		return nil
+	}
+	return ErrInvalidImageType
+}
+
+// Extension returns the file extension (with the leading dot) of images of
+// type t. An empty ImageType is treated as a JPEG, since images saved before
+// other types were supported have no type recorded on their copies.
+func (t ImageType) Extension() string {
+	switch t {
+	case ImageTypeWEBP:
+		return ".webp"
+	case ImageTypeAVIF:
+		return ".avif"
+	}
+	return ".jpg"
+}
+
+// ContentType returns the MIME type of images of type t.
+func (t ImageType) ContentType() string {
+	switch t {
+	case ImageTypeWEBP:
+		return "image/webp"
+	case ImageTypeAVIF:
+		return "image/avif"
+	}
+	return "image/jpeg"
+}
+
+func (t ImageType) bimgType() bimg.ImageType {
+	switch t {
+	case ImageTypeWEBP:
+		return bimg.WEBP
+	case ImageTypeAVIF:
+		return bimg.AVIF
+	}
+	return bimg.JPEG
+}
+
+// ImageTypeFromExtension returns the ImageType of files with extension ext
+// (with the leading dot). It returns false if ext is not of a supported type.
+func ImageTypeFromExtension(ext string) (ImageType, bool) {
+	switch ext {
+	case ".jpg":
+		return ImageTypeJPEG, true
+	case ".webp":
+		return ImageTypeWEBP, true
+	case ".avif":
+		return ImageTypeAVIF, true
+	}
+	return "", false
+}
+
 // Errors.
 var (
 	ErrInvalidImageFit  = errors.New("invalid image fit")
+	ErrInvalidImageType = errors.New("invalid image type")
 	ErrUnsupportedImage = errors.New("unsupported image format")
 	ErrNoImage          = errors.New("image buffer empty")
 )
@@ -132,11 +203,11 @@ func ContainInResolution(width, height, w, h int) (int, int) {
 	return int(x), int(y)
 }
 
-// AverageColor returns the average RGB color of img by averaging the colors of
-// at most 10000 pixels. Each RGB value is in the range of (0,255).
-func AverageColor(img image.Image) RGB {
-	width := img.Bounds().Dx()
-	height := img.Bounds().Dy()
+// samplePixels returns the colors of at most 10000 pixels of img, sampled at
+// even intervals.
+func samplePixels(img image.Image) []RGB {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
 
 	xsteps, ysteps := int(math.Floor(float64(width)/100.0)), int(math.Floor(float64(height)/100.0))
 	if xsteps <= 0 {
@@ -146,30 +217,226 @@ func AverageColor(img image.Image) RGB {
 		ysteps = 1
 	}
 
-	var r, g, b float64
+	pixels := make([]RGB, 0, (width/xsteps+1)*(height/ysteps+1))
 	for i := 0; i < width; i += xsteps {
 		for j := 0; j < height; j += ysteps {
-			c := img.At(i, j)
-			r2, g2, b2, _ := c.RGBA()
-			r = (r + float64(r2)) / 2
-			g = (g + float64(g2)) / 2
-			b = (b + float64(b2)) / 2
+			r, g, b, _ := img.At(bounds.Min.X+i, bounds.Min.Y+j).RGBA()
+			pixels = append(pixels, RGB{int(r >> 8), int(g >> 8), int(b >> 8)})
+		}
+	}
+	return pixels
+}
+
+// meanColor returns the mean of pixels.
+func meanColor(pixels []RGB) RGB {
+	var r, g, b int
+	for _, p := range pixels {
+		r += p.R
+		g += p.G
+		b += p.B
+	}
+	n := len(pixels)
+	if n == 0 {
+		return RGB{}
+	}
+	return RGB{(r + n/2) / n, (g + n/2) / n, (b + n/2) / n}
+}
+
+// AverageColor returns the average RGB color of img by averaging the colors of
+// at most 10000 pixels. Each RGB value is in the range of (0,255).
+func AverageColor(img image.Image) RGB {
+	return meanColor(samplePixels(img))
+}
+
+// PaletteColor is one of the dominant colors of an image.
+type PaletteColor struct {
+	RGB
+
+	// Proportion of the image, in the range of (0,1), that is closest to this
+	// color.
+	Proportion float64 `json:"proportion"`
+}
+
+// Palette returns at most n dominant colors of img, most dominant first,
+// found using the median cut algorithm on at most 10000 pixels.
+func Palette(img image.Image, n int) []PaletteColor {
+	pixels := samplePixels(img)
+	if len(pixels) == 0 || n <= 0 {
+		return nil
+	}
+
+	// Repeatedly split the box with the widest range of any channel at the
+	// median of that channel.
+	boxes := [][]RGB{pixels}
+	for len(boxes) < n {
+		split, channel, widest := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			c, r := widestChannel(box)
+			if r > widest {
+				split, channel, widest = i, c, r
+			}
+		}
+		if split == -1 {
+			break // all remaining boxes are a single color
+		}
+
+		box := boxes[split]
+		sort.Slice(box, func(i, j int) bool {
+			return channelValue(box[i], channel) < channelValue(box[j], channel)
+		})
+		mid := len(box) / 2
+		boxes[split] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+
+	palette := make([]PaletteColor, len(boxes))
+	for i, box := range boxes {
+		palette[i] = PaletteColor{
+			RGB:        meanColor(box),
+			Proportion: float64(len(box)) / float64(len(pixels)),
+		}
+	}
+	sort.SliceStable(palette, func(i, j int) bool {
+		return palette[i].Proportion > palette[j].Proportion
+	})
+	return palette
+}
+
+func channelValue(c RGB, channel int) int {
+	switch channel {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	}
+	return c.B
+}
+
+// widestChannel returns the channel (0 for red, 1 for green, 2 for blue) with
+// the largest range of values in pixels, and that range.
+func widestChannel(pixels []RGB) (int, int) {
+	min := [3]int{255, 255, 255}
+	max := [3]int{}
+	for _, p := range pixels {
+		for c := 0; c < 3; c++ {
+			v := channelValue(p, c)
+			if v < min[c] {
+				min[c] = v
+			}
+			if v > max[c] {
+				max[c] = v
+			}
+		}
+	}
+	channel := 0
+	for c := 1; c < 3; c++ {
+		if max[c]-min[c] > max[channel]-min[channel] {
+			channel = c
 		}
 	}
+	return channel, max[channel] - min[channel]
+}
+
+// PerceptualHash is a 64-bit difference hash (dHash) of an image. Unlike a
+// cryptographic hash, resized or re-encoded versions of the same image have
+// hashes that differ in only a few bits.
+type PerceptualHash uint64
+
+// Distance returns the Hamming distance between h and x.
+func (h PerceptualHash) Distance(x PerceptualHash) int {
+	return bits.OnesCount64(uint64(h ^ x))
+}
+
+// MarshalText implements encoding.TextMarshaler interface. Output is 16
+// hexadecimal digits.
+func (h PerceptualHash) MarshalText() ([]byte, error) {
+	s := strconv.FormatUint(uint64(h), 16)
+	return []byte(strings.Repeat("0", 16-len(s)) + s), nil
+}
 
-	var c RGB
-	x := r + g + b
-	if x > 0 {
-		c.R = int(r / x * 255.0)
-		c.G = int(g / x * 255.0)
-		c.B = int(b / x * 255.0)
+// UnmarshalText implements encoding.TextUnmarshaler interface.
+func (h *PerceptualHash) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(string(text), 16, 64)
+	if err != nil {
+		return err
 	}
-	return c
+	*h = PerceptualHash(v)
+	return nil
+}
+
+// DHash returns the difference hash of img. img is shrunk to a 9x8 grayscale
+// image and each bit of the hash is set if a pixel is brighter than the pixel
+// to its right.
+func DHash(img image.Image) PerceptualHash {
+	const w, h = 9, 8
+	var gray [h][w]float64
+
+	bounds := img.Bounds()
+	dx, dy := bounds.Dx(), bounds.Dy()
+	if dx == 0 || dy == 0 {
+		return 0
+	}
+
+	// Average the pixels that fall in each cell, sampling at most 16x16 pixels
+	// per cell.
+	for y := 0; y < h; y++ {
+		y0, y1 := bounds.Min.Y+y*dy/h, bounds.Min.Y+(y+1)*dy/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		ystep := (y1-y0)/16 + 1
+		for x := 0; x < w; x++ {
+			x0, x1 := bounds.Min.X+x*dx/w, bounds.Min.X+(x+1)*dx/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			xstep := (x1-x0)/16 + 1
+			var sum float64
+			n := 0
+			for j := y0; j < y1; j += ystep {
+				for i := x0; i < x1; i += xstep {
+					r, g, b, _ := img.At(i, j).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					n++
+				}
+			}
+			gray[y][x] = sum / float64(n)
+		}
+	}
+
+	var hash PerceptualHash
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// BlurHash returns the BlurHash of img, with more components along its longer
+// side.
+func BlurHash(img image.Image) (string, error) {
+	if img.Bounds().Dx() >= img.Bounds().Dy() {
+		return blurhash.Encode(4, 3, img)
+	}
+	return blurhash.Encode(3, 4, img)
 }
 
 // ToJPEG converts the image to a JPEG, if it's not already, and fits the image
 // into maxWidth and maxHeight according to fit.
 func ToJPEG(image []byte, maxWidth, maxHeight int, fit ImageFit) ([]byte, ImageSize, error) {
+	return ToImageType(image, maxWidth, maxHeight, fit, ImageTypeJPEG)
+}
+
+// ToImageType converts the image to type t, if it's not already, and fits the
+// image into maxWidth and maxHeight according to fit.
+func ToImageType(image []byte, maxWidth, maxHeight int, fit ImageFit, t ImageType) ([]byte, ImageSize, error) {
 	s := ImageSize{}
 	bytes, err := bimg.NewImage(image).Process(bimg.Options{
 		StripMetadata: true,
@@ -178,8 +445,8 @@ func ToJPEG(image []byte, maxWidth, maxHeight int, fit ImageFit) ([]byte, ImageS
 	if err != nil {
 		return nil, s, err
 	}
-	if img.Type() != bimg.ImageTypeName(bimg.JPEG) {
-		if _, err := img.Convert(bimg.JPEG); err != nil {
+	if img.Type() != bimg.ImageTypeName(t.bimgType()) {
+		if _, err := img.Convert(t.bimgType()); err != nil {
 			return nil, s, bimgError(err)
 		}
 	}
@@ -203,6 +470,33 @@ func ToJPEG(image []byte, maxWidth, maxHeight int, fit ImageFit) ([]byte, ImageS
 	return image, s, bimgError(err)
 }
 
+// DecodeImage decodes buf, an image of type t, into an image.Image. Images
+// that are not JPEGs are converted to one first.
+func DecodeImage(buf []byte, t ImageType) (image.Image, error) {
+	if t != ImageTypeJPEG {
+		var err error
+		if buf, err = bimg.NewImage(buf).Convert(bimg.JPEG); err != nil {
+			return nil, bimgError(err)
+		}
+	}
+	return jpeg.Decode(bytes.NewReader(buf))
+}
+
+// analysisSize is the size images are scaled down to fit in before their
+// colors and hashes are computed. Decoding them at full size would take far
+// more memory for no better results.
+const analysisSize = 256
+
+// decodeForAnalysis decodes buf, scaled down to fit in analysisSize, into an
+// image.Image.
+func decodeForAnalysis(buf []byte) (image.Image, error) {
+	small, _, err := ToImageType(buf, analysisSize, analysisSize, ImageFitContain, ImageTypeJPEG)
+	if err != nil {
+		return nil, err
+	}
+	return jpeg.Decode(bytes.NewReader(small))
+}
+
 func bimgError(err error) error {
 	if err == nil {
 		return nil
@@ -1,6 +1,10 @@
 package citra
 
-import "testing"
+import (
+	"image"
+	"image/color"
+	"testing"
+)
 
 func TestImageSizeMarshal(t *testing.T) {
 	list := []struct {
@@ -46,3 +50,83 @@ func TestImageSizeUnmarshal(t *testing.T) {
 	}
 
 }
+
+func TestImageTypeUnmarshal(t *testing.T) {
+	list := []struct {
+		text string
+		want ImageType
+	}{
+		{"jpeg", ImageTypeJPEG},
+		{"webp", ImageTypeWEBP},
+		{"", ImageTypeDefault},
+	}
+
+	var imageType ImageType
+	for _, item := range list {
+		err := imageType.UnmarshalText([]byte(item.text))
+		if err != nil || imageType != item.want {
+			t.Fatalf("ImageType unmarshal: want %v, got %v (error: %v)", item.want, imageType, err)
+		}
+	}
+
+	if err := imageType.UnmarshalText([]byte("png")); err != ErrInvalidImageType {
+		t.Fatalf("ImageType unmarshal: want ErrInvalidImageType on (png), got %v", err)
+	}
+}
+
+func TestDHash(t *testing.T) {
+	// Horizontal gradient, brightest on the left.
+	img := image.NewGray(image.Rect(0, 0, 90, 80))
+	for x := 0; x < 90; x++ {
+		for y := 0; y < 80; y++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(255 - x*2)})
+		}
+	}
+	if h := DHash(img); h != PerceptualHash(^uint64(0)) {
+		t.Fatalf("DHash of gradient: want all bits set, got %016x", uint64(h))
+	}
+
+	// A resized copy should hash the same.
+	small := image.NewGray(image.Rect(0, 0, 45, 40))
+	for x := 0; x < 45; x++ {
+		for y := 0; y < 40; y++ {
+			small.SetGray(x, y, color.Gray{Y: uint8(255 - x*4)})
+		}
+	}
+	if d := DHash(img).Distance(DHash(small)); d != 0 {
+		t.Fatalf("DHash distance of resized image: want 0, got %v", d)
+	}
+
+	text, _ := PerceptualHash(0xff).MarshalText()
+	if string(text) != "00000000000000ff" {
+		t.Fatalf("PerceptualHash marshal: got %v", string(text))
+	}
+}
+
+func TestAverageColorAndPalette(t *testing.T) {
+	// Left half black, right half dark red.
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 100; y++ {
+			if x >= 100 {
+				img.Set(x, y, color.RGBA{R: 100, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{A: 255})
+			}
+		}
+	}
+
+	if c := AverageColor(img); c != (RGB{50, 0, 0}) {
+		t.Fatalf("AverageColor: want {50 0 0}, got %v", c)
+	}
+
+	palette := Palette(img, 5)
+	if len(palette) != 2 {
+		t.Fatalf("Palette: want 2 colors, got %v", palette)
+	}
+	for _, item := range palette {
+		if item.Proportion != 0.5 || (item.RGB != RGB{} && item.RGB != RGB{100, 0, 0}) {
+			t.Fatalf("Palette: unexpected color %v", item)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package citra
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/previnder/citra/pkg/luid"
+)
+
+// Job statuses.
+const (
+	JobPending    = "pending"
+	JobProcessing = "processing"
+	JobReady      = "ready"
+	JobFailed     = "failed"
+)
+
+// Job is a record in jobs table: an upload that is saved in the background.
+type Job struct {
+	// ID of the job, which is also the ID of the image it saves.
+	ID luid.ID `json:"id"`
+
+	Status string `json:"status"`
+
+	// ID of the image saved, once the job is ready. It differs from ID if the
+	// upload was deduplicated into an existing image.
+	ImageID luid.NullID `json:"imageId"`
+
+	// Set if the job failed.
+	Error string `json:"error,omitempty"`
+
+	Copies []SaveImageArg `json:"-"`
+	Preset string         `json:"-"`
+
+	// Job runner that claimed the job, if it is processing.
+	ClaimedBy string `json:"-"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// jobFilePath returns the name, in a Storage, of the upload of job with ID.
+func jobFilePath(ID luid.ID) string {
+	return "jobs/" + ID.String()
+}
+
+// CreateJob stores the upload buf in store and creates a pending job that
+// saves it as SaveImage would. The job is run by RunJob. Uploads that SaveImage
+// would reject right away, including ones that are not images, are rejected
+// with the same errors.
+func CreateJob(db *sql.DB, store Storage, buf []byte, copies []SaveImageArg, preset string) (*Job, error) {
+	if len(buf) == 0 {
+		return nil, ErrNoImage
+	}
+	if _, _, err := GetImageSize(buf); err != nil {
+		return nil, err
+	}
+	hasDefault := false
+	for _, item := range copies {
+		hasDefault = hasDefault || item.IsDefault
+	}
+	if !hasDefault {
+		return nil, ErrNoDefaultImage
+	}
+
+	ID, now := luid.New()
+	if err := store.Put(jobFilePath(ID), buf); err != nil {
+		return nil, err
+	}
+
+	copiesJSON, _ := json.Marshal(copies)
+	_, err := db.Exec("insert into jobs (id, status, copies, preset, created_at, updated_at) values (?, ?, ?, ?, ?, ?)",
+		ID, JobPending, copiesJSON, sql.NullString{String: preset, Valid: preset != ""}, now, now)
+	if err != nil {
+		store.Delete(jobFilePath(ID))
+		return nil, err
+	}
+
+	return &Job{ID: ID, Status: JobPending, Copies: copies, Preset: preset, CreatedAt: now}, nil
+}
+
+// jobColumns are the columns of jobs table scanned by scanJob.
+const jobColumns = "id, status, copies, preset, image_id, error, claimed_by, created_at"
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	job := &Job{}
+	var copies []byte
+	var preset, jobError, claimedBy sql.NullString
+	err := row.Scan(&job.ID, &job.Status, &copies, &preset, &job.ImageID, &jobError, &claimedBy, &job.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(copies, &job.Copies); err != nil {
+		return nil, errors.New("error unmarshaling copies: " + err.Error())
+	}
+	job.Preset = preset.String
+	job.Error = jobError.String
+	job.ClaimedBy = claimedBy.String
+	return job, nil
+}
+
+// GetJob returns the job with ID.
+func GetJob(db *sql.DB, ID luid.ID) (*Job, error) {
+	return scanJob(db.QueryRow("select "+jobColumns+" from jobs where id = ?", ID))
+}
+
+// Job runners update the heartbeat of the jobs they run every
+// jobHeartbeatInterval. Jobs whose heartbeat is older than jobStaleAfter are
+// taken to be abandoned, by a runner that stopped, and are run again.
+const (
+	jobHeartbeatInterval = 10 * time.Second
+	jobStaleAfter        = time.Minute
+)
+
+// finishedJobRetention is how long ready and failed jobs are kept, so that the
+// images of asynchronous uploads can be looked up by the IDs of their jobs.
+// Images that were not deduplicated have the same ID as their job and can be
+// looked up afterwards too.
+const finishedJobRetention = 7 * 24 * time.Hour
+
+// newJobRunnerID returns an ID, unique among all servers, for the job runners
+// of a server.
+func newJobRunnerID() string {
+	host, _ := os.Hostname()
+	ID, _ := luid.New()
+	return host + "-" + strconv.Itoa(os.Getpid()) + "-" + ID.String()
+}
+
+// claimJob marks the oldest pending job as processing, claimed by runner, and
+// returns it. It returns nil if there are no pending jobs.
+func claimJob(db *sql.DB, runner string) (*Job, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := scanJob(tx.QueryRow("select "+jobColumns+" from jobs where status = ? order by created_at limit 1 for update", JobPending))
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	res, err := tx.Exec("update jobs set status = ?, claimed_by = ?, heartbeat_at = ?, updated_at = ? where id = ? and status = ?",
+		JobProcessing, runner, now, now, job.ID, JobPending)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback() // claimed concurrently
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	job.Status = JobProcessing
+	job.ClaimedBy = runner
+	return job, nil
+}
+
+// errJobLost is returned by RunJob if the job was reset by resetStaleJobs, and
+// possibly claimed by another runner, while it ran.
+var errJobLost = errors.New("job was claimed by another runner")
+
+// RunJob saves the upload of job, which must be processing and claimed by
+// claimJob, in pool and marks the job ready or failed. If pool is full the job
+// is made pending again, to be retried later, and ErrBusy is returned. pool may
+// be nil. The heartbeat of the job is updated while it runs.
+func RunJob(db *sql.DB, store Storage, layout FolderLayout, pool *Pool, job *Job) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(jobHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := db.Exec("update jobs set heartbeat_at = ? where id = ? and claimed_by = ?", time.Now(), job.ID, job.ClaimedBy)
+				if err != nil {
+					log.Println("Error updating heartbeat of job", job.ID, ":", err)
+				}
+			}
+		}
+	}()
+
+	// The image may have been saved, or the upload deduplicated, by a run
+	// that was interrupted before the job was finished. image_id of the job is
+	// set along with either.
+	var image *DBImage
+	var imageID luid.NullID
+	err := db.QueryRow("select image_id from jobs where id = ?", job.ID).Scan(&imageID)
+	if err == nil && imageID.Valid {
+		image, err = GetImage(db, imageID.ID)
+	} else if err == nil {
+		var buf []byte
+		if buf, err = ReadFile(store, jobFilePath(job.ID)); err == nil {
+			err = pool.Do(func() (err error) {
+				image, err = saveImage(db, store, layout, job.ID, buf, job.Copies, job.Preset, true)
+				return
+			})
+		}
+	}
+
+	switch {
+	case err == ErrBusy:
+		_, err2 := db.Exec("update jobs set status = ?, claimed_by = null, heartbeat_at = null, updated_at = ? where id = ? and claimed_by = ?",
+			JobPending, time.Now(), job.ID, job.ClaimedBy)
+		if err2 != nil {
+			return err2
+		}
+		return err
+	case err != nil:
+		job.Status, job.Error = JobFailed, err.Error()
+	default:
+		job.Status = JobReady
+		job.ImageID = luid.NullID{ID: image.ID, Valid: true}
+	}
+
+	res, err := db.Exec(`update jobs set status = ?, image_id = ?, error = ?, claimed_by = null, heartbeat_at = null,
+		updated_at = ? where id = ? and claimed_by = ?`,
+		job.Status, job.ImageID, sql.NullString{String: job.Error, Valid: job.Error != ""}, time.Now(), job.ID, job.ClaimedBy)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errJobLost
+	}
+
+	if err = store.Delete(jobFilePath(job.ID)); err != nil && !os.IsNotExist(err) {
+		log.Println("Error deleting upload of job", job.ID, ":", err)
+	}
+	return nil
+}
+
+// resetStaleJobs makes processing jobs whose heartbeat is older than
+// jobStaleAfter (whose runner stopped while running them) pending again.
+func resetStaleJobs(db *sql.DB) error {
+	_, err := db.Exec(`update jobs set status = ?, claimed_by = null, heartbeat_at = null, updated_at = ?
+		where status = ? and heartbeat_at < ?`, JobPending, time.Now(), JobProcessing, time.Now().Add(-jobStaleAfter))
+	return err
+}
+
+// deleteFinishedJobs deletes ready and failed jobs created before t.
+func deleteFinishedJobs(db *sql.DB, t time.Time) error {
+	_, err := db.Exec("delete from jobs where status in (?, ?) and created_at < ?", JobReady, JobFailed, t)
+	return err
+}
+
+// runJobs runs pending jobs, one at a time, as runner, until ctx is done. It
+// checks for new jobs every interval, or as soon as a value is received on
+// wake. Every jobStaleAfter it also resets stale jobs, to run them again, and
+// deletes old finished jobs. Multiple runJobs may run concurrently, on any
+// number of servers.
+func runJobs(ctx context.Context, db *sql.DB, store Storage, layout FolderLayout, pool *Pool, runner string, wake <-chan struct{}, interval time.Duration) {
+	var lastCleanup time.Time
+	for ctx.Err() == nil {
+		if time.Since(lastCleanup) > jobStaleAfter {
+			lastCleanup = time.Now()
+			if err := resetStaleJobs(db); err != nil {
+				log.Println("Error resetting stale jobs:", err)
+			}
+			if err := deleteFinishedJobs(db, time.Now().Add(-finishedJobRetention)); err != nil {
+				log.Println("Error deleting finished jobs:", err)
+			}
+		}
+
+		job, err := claimJob(db, runner)
+		if err != nil {
+			log.Println("Error claiming job:", err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-wake:
+			case <-time.After(interval):
+			}
+			continue
+		}
+
+		if err = RunJob(db, store, layout, pool, job); err != nil {
+			log.Println("Error running job", job.ID, ":", err)
+			if err == ErrBusy {
+				select {
+				case <-ctx.Done():
+				case <-time.After(interval):
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package citra
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRunJob(t *testing.T) {
+	db := openTestDB(t)
+	store := &DiskStorage{Root: t.TempDir()}
+	copies := []SaveImageArg{
+		{MaxWidth: 64, MaxHeight: 64, ImageFit: ImageFitContain, IsDefault: true},
+		{MaxWidth: 16, MaxHeight: 16, ImageFit: ImageFitCover},
+	}
+
+	job, err := CreateJob(db, store, testJPEG(t), copies, "")
+	if err != nil {
+		t.Fatal("CreateJob: ", err)
+	}
+	if job, err = GetJob(db, job.ID); err != nil || job.Status != JobPending {
+		t.Fatalf("GetJob: want pending job, got %+v (error: %v)", job, err)
+	}
+
+	// Claim the job as claimJob would; other pending jobs may be older.
+	if _, err = db.Exec("update jobs set status = ?, claimed_by = ?, heartbeat_at = now() where id = ?", JobProcessing, "test", job.ID); err != nil {
+		t.Fatal(err)
+	}
+	job.Status, job.ClaimedBy = JobProcessing, "test"
+	if err = RunJob(db, store, FolderLayout{}, nil, job); err != nil {
+		t.Fatal("RunJob: ", err)
+	}
+	if job, err = GetJob(db, job.ID); err != nil || job.Status != JobReady || job.ImageID.ID != job.ID {
+		t.Fatalf("GetJob: want ready job, got %+v (error: %v)", job, err)
+	}
+
+	image, err := GetImage(db, job.ID)
+	if err != nil {
+		t.Fatal("GetImage: ", err)
+	}
+	if len(image.Copies) != 1 || image.Status != JobReady {
+		t.Fatalf("want a ready image with 1 copy, got %+v", image)
+	}
+	if _, err = store.Stat(jobFilePath(job.ID)); !os.IsNotExist(err) {
+		t.Fatalf("Stat of upload of finished job: want not exist error, got %v", err)
+	}
+
+	if _, err = CreateJob(db, store, testJPEG(t), copies[1:], ""); err != ErrNoDefaultImage {
+		t.Fatalf("CreateJob without default copy: want ErrNoDefaultImage, got %v", err)
+	}
+	if _, err = CreateJob(db, store, []byte("not an image"), copies, ""); err != ErrUnsupportedImage {
+		t.Fatalf("CreateJob of a non-image: want ErrUnsupportedImage, got %v", err)
+	}
+
+	if err = deleteFinishedJobs(db, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal("deleteFinishedJobs: ", err)
+	}
+	if _, err = GetJob(db, job.ID); err != sql.ErrNoRows {
+		t.Fatalf("GetJob of deleted job: want sql.ErrNoRows, got %v", err)
+	}
+}
+
+// runJobAgain runs job as if a runner had stopped after saving its image but
+// before finishing it, and the job had been claimed again.
+func runJobAgain(t *testing.T, db *sql.DB, store Storage, job *Job) {
+	_, err := db.Exec("update jobs set status = ?, claimed_by = ?, heartbeat_at = now() where id = ?", JobProcessing, "test", job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Status, job.ClaimedBy = JobProcessing, "test"
+	if err = RunJob(db, store, FolderLayout{}, nil, job); err != nil {
+		t.Fatal("RunJob: ", err)
+	}
+}
+
+func TestRunJobTwice(t *testing.T) {
+	db := openTestDB(t)
+	store := &DiskStorage{Root: t.TempDir()}
+	copies := []SaveImageArg{{MaxWidth: 64, MaxHeight: 64, ImageFit: ImageFitContain, IsDefault: true}}
+	buf := testJPEG(t)
+
+	// The first job saves the image, the second is deduplicated into it.
+	for i, want := range []int{1, 2} {
+		job, err := CreateJob(db, store, buf, copies, "")
+		if err != nil {
+			t.Fatal("CreateJob: ", err)
+		}
+		runJobAgain(t, db, store, job)
+		runJobAgain(t, db, store, job)
+
+		if job, err = GetJob(db, job.ID); err != nil || job.Status != JobReady {
+			t.Fatalf("GetJob: want ready job, got %+v (error: %v)", job, err)
+		}
+		image, err := GetImage(db, job.ImageID.ID)
+		if err != nil {
+			t.Fatal("GetImage: ", err)
+		}
+		if image.RefCount != want {
+			t.Fatalf("job %d: want ref count %d, got %d", i, want, image.RefCount)
+		}
+	}
+}
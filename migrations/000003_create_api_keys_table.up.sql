@@ -0,0 +1,11 @@
+create table if not exists api_keys (
+	id binary (12) not null,
+	name varchar (255) not null,
+	key_hash binary (32) not null, /* sha256 of the key */
+	scopes varchar (255) not null, /* comma separated */
+	created_at datetime not null default current_timestamp(),
+	revoked_at datetime,
+
+	unique (key_hash),
+	primary key (id)
+);
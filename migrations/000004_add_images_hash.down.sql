@@ -0,0 +1,5 @@
+alter table images
+	drop index images_hash,
+	drop column hash,
+	drop column args_hash,
+	drop column ref_count;
@@ -0,0 +1,5 @@
+alter table images
+	add column hash binary (32), /* sha256 of the uploaded image */
+	add column args_hash binary (32), /* sha256 of the arguments the image was saved with */
+	add column ref_count int not null default 1, /* number of uploads deduplicated into this image */
+	add index images_hash (hash, args_hash);
@@ -0,0 +1 @@
+alter table images add column phash bigint; /* 64-bit dHash, see PerceptualHash */
@@ -0,0 +1 @@
+alter table images add column blurhash varchar (64);
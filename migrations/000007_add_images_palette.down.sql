@@ -0,0 +1 @@
+alter table images drop column palette;
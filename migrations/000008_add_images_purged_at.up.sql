@@ -0,0 +1,2 @@
+/* Set when the files of a deleted image are permanently removed. */
+alter table images add column purged_at datetime;
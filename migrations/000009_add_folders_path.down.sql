@@ -0,0 +1,3 @@
+alter table folders
+	drop index folders_path,
+	drop column path;
@@ -0,0 +1,3 @@
+alter table folders
+	add column path varchar (64), /* path of the folder in storage, if other than its id */
+	add unique index folders_path (path);
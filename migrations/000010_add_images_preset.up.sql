@@ -0,0 +1,2 @@
+/* Name of the preset (see Config.Presets) the image was uploaded with. */
+alter table images add column preset varchar (64);
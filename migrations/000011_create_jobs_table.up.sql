@@ -0,0 +1,13 @@
+create table if not exists jobs (
+	id binary (12) not null, /* also the ID of the image to be saved */
+	`status` varchar (16) not null, /* pending, processing, ready, or failed */
+	copies JSON not null, /* arguments to SaveImage */
+	preset varchar (64),
+	image_id binary (12), /* ID of the image saved, which differs from id if deduplicated */
+	error text,
+	created_at datetime not null default current_timestamp(),
+	updated_at datetime not null default current_timestamp(),
+
+	index jobs_status (`status`, created_at),
+	primary key (id)
+);
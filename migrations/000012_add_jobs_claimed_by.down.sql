@@ -0,0 +1 @@
+alter table jobs drop column claimed_by, drop column heartbeat_at;
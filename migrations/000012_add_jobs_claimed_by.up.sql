@@ -0,0 +1,2 @@
+/* The server running a processing job, and when it last reported it was still running it. */
+alter table jobs add column claimed_by varchar (128), add column heartbeat_at datetime;
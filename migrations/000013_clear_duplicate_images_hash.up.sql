@@ -0,0 +1,3 @@
+/* Identical uploads saved concurrently before images_hash was unique are left out of deduplication, all but the first. */
+update images a join images b on a.hash = b.hash and a.args_hash = b.args_hash and b.id < a.id
+	set a.hash = null where a.is_deleted = false and b.is_deleted = false;
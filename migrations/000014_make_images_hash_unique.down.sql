@@ -0,0 +1,4 @@
+alter table images
+	drop index images_hash,
+	drop column live,
+	add index images_hash (hash, args_hash);
@@ -0,0 +1,4 @@
+alter table images
+	add column live tinyint as (if(is_deleted, null, 1)) stored, /* 1 unless deleted, so that only non-deleted images are unique */
+	drop index images_hash,
+	add unique index images_hash (hash, args_hash, live);
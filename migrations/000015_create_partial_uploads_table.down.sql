@@ -0,0 +1 @@
+drop table partial_uploads;
@@ -0,0 +1,12 @@
+create table if not exists partial_uploads (
+	id binary (12) not null,
+	length bigint not null,
+	request JSON not null, /* parameters of the upload, an uploadRequest */
+	received bigint not null default 0, /* number of bytes received so far */
+	locked_by varchar (32), /* request writing the upload, if any */
+	locked_at datetime,
+	updated_at datetime not null, /* when the last chunk was received */
+
+	index partial_uploads_updated_at (updated_at),
+	primary key (id)
+);
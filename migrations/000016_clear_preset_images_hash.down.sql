@@ -0,0 +1,2 @@
+/* Cleared hashes are not restored. */
+do 0;
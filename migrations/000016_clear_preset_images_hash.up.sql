@@ -0,0 +1,2 @@
+/* Images of presets were saved with an args_hash that left out the preset, so they are left out of deduplication. */
+update images set hash = null where preset is not null;
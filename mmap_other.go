@@ -0,0 +1,21 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package citra
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the first size bytes of f. Memory mapping is not supported on
+// this platform.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	_, err := io.ReadFull(io.NewSectionReader(f, 0, int64(size)), buf)
+	return buf, err
+}
+
+func unmapFile(b []byte) error {
+	return nil
+}
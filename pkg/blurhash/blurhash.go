@@ -0,0 +1,157 @@
+// Package blurhash implements the BlurHash encoder. A BlurHash is a short
+// string that decodes into a blurred placeholder of an image.
+//
+// See https://blurha.sh for the algorithm and decoders.
+package blurhash
+
+import (
+	"errors"
+	"image"
+	"math"
+	"strings"
+)
+
+const characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// maxSamples is the maximum number of pixels sampled along each axis of an
+// image. Larger images are sampled at intervals.
+const maxSamples = 128
+
+// ErrInvalidComponents is returned when the number of components is not
+// between 1 and 9.
+var ErrInvalidComponents = errors.New("blurhash: components must be between 1 and 9")
+
+// Encode returns the BlurHash of img with xComponents horizontal and
+// yComponents vertical components. More components preserve more detail at
+// the cost of a longer hash. 4 and 3 are reasonable for a landscape image.
+func Encode(xComponents, yComponents int, img image.Image) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", ErrInvalidComponents
+	}
+
+	bounds := img.Bounds()
+	xs := samplePoints(bounds.Min.X, bounds.Dx())
+	ys := samplePoints(bounds.Min.Y, bounds.Dy())
+	if len(xs) == 0 || len(ys) == 0 {
+		return "", errors.New("blurhash: empty image")
+	}
+
+	// Linear RGB values of sampled pixels.
+	pixels := make([][3]float64, len(xs)*len(ys))
+	for j, y := range ys {
+		for i, x := range xs {
+			r, g, b, _ := img.At(x, y).RGBA()
+			pixels[j*len(xs)+i] = [3]float64{
+				sRGBToLinear(int(r >> 8)),
+				sRGBToLinear(int(g >> 8)),
+				sRGBToLinear(int(b >> 8)),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for cy := 0; cy < yComponents; cy++ {
+		for cx := 0; cx < xComponents; cx++ {
+			factors = append(factors, multiplyBasis(pixels, len(xs), len(ys), cx, cy))
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maximumValue = float64(quantisedMax+1) / 166
+		b.WriteString(encode83(quantisedMax, 1))
+	} else {
+		b.WriteString(encode83(0, 1))
+	}
+
+	dc := factors[0]
+	b.WriteString(encode83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+
+	for _, f := range factors[1:] {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+		}
+		b.WriteString(encode83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2))
+	}
+
+	return b.String(), nil
+}
+
+// samplePoints returns at most maxSamples evenly spaced coordinates in
+// [min, min+n).
+func samplePoints(min, n int) []int {
+	step := 1
+	if n > maxSamples {
+		step = (n + maxSamples - 1) / maxSamples
+	}
+	var points []int
+	for i := 0; i < n; i += step {
+		points = append(points, min+i)
+	}
+	return points
+}
+
+func multiplyBasis(pixels [][3]float64, width, height, cx, cy int) [3]float64 {
+	var r, g, b float64
+	normalisation := 2.0
+	if cx == 0 && cy == 0 {
+		normalisation = 1
+	}
+
+	xBasis := make([]float64, width)
+	for x := range xBasis {
+		xBasis[x] = math.Cos(math.Pi * float64(cx) * float64(x) / float64(width))
+	}
+	for y := 0; y < height; y++ {
+		yBasis := math.Cos(math.Pi * float64(cy) * float64(y) / float64(height))
+		for x := 0; x < width; x++ {
+			basis := normalisation * xBasis[x] * yBasis
+			p := pixels[y*width+x]
+			r += basis * p[0]
+			g += basis * p[1]
+			b += basis * p[2]
+		}
+	}
+
+	scale := 1 / float64(width*height)
+	return [3]float64{r * scale, g * scale, b * scale}
+}
+
+func encode83(value, length int) string {
+	var b strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		b.WriteByte(characters[digit])
+	}
+	return b.String()
+}
+
+func sRGBToLinear(value int) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
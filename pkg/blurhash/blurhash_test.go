@@ -0,0 +1,35 @@
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeSolidColor(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	for x := 0; x < 32; x++ {
+		for y := 0; y < 24; y++ {
+			img.Set(x, y, color.RGBA{R: 255, A: 255})
+		}
+	}
+
+	hash, err := Encode(4, 3, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Size flag, quantised maximum, DC (pure red), and 11 AC components.
+	if len(hash) != 1+1+4+11*2 {
+		t.Fatalf("Encode: want hash of length 28, got %v", hash)
+	}
+	if hash[0] != 'L' {
+		t.Fatalf("Encode: want size flag L, got %c", hash[0])
+	}
+	if dc := encode83(255<<16, 4); hash[2:6] != dc {
+		t.Fatalf("Encode: want DC component %v, got %v", dc, hash[2:6])
+	}
+
+	if _, err = Encode(0, 3, img); err != ErrInvalidComponents {
+		t.Fatalf("Encode with 0 components: want ErrInvalidComponents, got %v", err)
+	}
+}
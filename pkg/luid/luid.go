@@ -58,6 +58,11 @@ func (d *ID) Zero() {
 	}
 }
 
+// Time returns the time (in UTC) encoded in the first 8 bytes of ID.
+func (d ID) Time() time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(d[:8]))).UTC()
+}
+
 // String returns the hexadecimal encoding of ID.
 func (d ID) String() string {
 	return hex.EncodeToString(d[:])
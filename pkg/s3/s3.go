@@ -0,0 +1,325 @@
+// Package s3 implements a minimal client for S3 compatible object storage
+// services (AWS S3, MinIO, etc.). Only the operations citra needs are
+// supported, and buckets are always addressed path-style.
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when an object does not exist.
+var ErrNotFound = errors.New("s3: object not found")
+
+// emptyHash is the hex encoded SHA-256 hash of an empty payload.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Client is an S3 client. Its fields must not be changed after first use.
+type Client struct {
+	// Endpoint is the base URL of the service, for example
+	// "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000".
+	Endpoint string
+
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// ObjectInfo describes an object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Error is an error response returned by the service.
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("s3: %v %v (status %v)", e.Code, e.Message, e.StatusCode)
+}
+
+// PutObject uploads data as the object key.
+func (c *Client) PutObject(key string, data []byte, contentType string) error {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	res, err := c.do("PUT", key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// GetObject returns the contents of object key starting at offset. The caller
+// must close the returned reader.
+func (c *Client) GetObject(key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	res, err := c.do("GET", key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// HeadObject returns information about object key.
+func (c *Client) HeadObject(key string) (*ObjectInfo, error) {
+	res, err := c.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	info := &ObjectInfo{Key: key, Size: res.ContentLength}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = t
+	}
+	return info, nil
+}
+
+// CopyObject copies object src to dst within the bucket.
+func (c *Client) CopyObject(src, dst string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", escapePath("/"+c.Bucket+"/"+src))
+	res, err := c.do("PUT", dst, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// A copy can fail after the response status has been sent, in which case
+	// the body is an error document.
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	e := &Error{StatusCode: res.StatusCode}
+	if xml.Unmarshal(data, e) == nil && e.Code != "" {
+		return e
+	}
+	return nil
+}
+
+// DeleteObject deletes object key. Deleting an object that does not exist is
+// not an error.
+func (c *Client) DeleteObject(key string) error {
+	res, err := c.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// ListObjects returns all objects whose keys begin with prefix.
+func (c *Client) ListObjects(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		res, err := c.do("GET", "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range result.Contents {
+			objects = append(objects, ObjectInfo{Key: item.Key, Size: item.Size, LastModified: item.LastModified})
+		}
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do sends a signed request for object key (or the bucket if key is empty). A
+// non-2xx response is returned as an error.
+func (c *Client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.Endpoint, "/") + "/" + c.Bucket + "/" + key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		req.Body = nil
+	}
+	c.sign(req, body, time.Now().UTC())
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	e := &Error{StatusCode: res.StatusCode}
+	data, _ := ioutil.ReadAll(res.Body)
+	xml.Unmarshal(data, e)
+	return nil, e
+}
+
+// sign signs req with AWS Signature Version 4. Headers host, range, and all
+// x-amz-* headers are signed.
+func (c *Client) sign(req *http.Request, body []byte, t time.Time) {
+	payloadHash := emptyHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		escapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := q[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, escape(k, true)+"="+escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func escapePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return escape(p, false)
+}
+
+// escape URI encodes s as SigV4 requires. Slashes are encoded only if
+// encodeSlash is true.
+func escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,90 @@
+// Package urlsign signs and verifies the image URLs served by citra so that
+// only holders of the secret can create URLs that request copies of images.
+//
+// The package has no dependencies outside of the standard library so that
+// backends can sign URLs without linking against libvips.
+package urlsign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Param is the name of the query parameter that carries the signature.
+const Param = "sig"
+
+// ErrInvalidURL is returned when a URL is not of the form
+// /images/{folder}/{imageID}[.{ext}], where folder is a path of one or more
+// parts, such as "1000" or "2022/03/14".
+var ErrInvalidURL = errors.New("invalid image URL")
+
+// Signature returns the signature of an image URL with the given folder path,
+// image ID, extension (with the leading dot, or empty), and size and fit query
+// values (as they appear in the URL).
+func Signature(secret []byte, folder, imageID, ext, size, fit string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(folder + "/" + imageID + "/" + ext + "/" + size + "/" + fit))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// PresetSignature returns the signature of an image URL with the given folder
+// path, image ID, extension, and preset query value.
+func PresetSignature(secret []byte, folder, imageID, ext, preset string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(folder + "/" + imageID + "/" + ext + "/preset:" + preset))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// signature returns the signature of an image URL with query q: a preset
+// signature if q has a preset, otherwise a size and fit one.
+func signature(secret []byte, folder, imageID, ext string, q url.Values) string {
+	if preset := q.Get("preset"); preset != "" {
+		return PresetSignature(secret, folder, imageID, ext, preset)
+	}
+	return Signature(secret, folder, imageID, ext, q.Get("size"), q.Get("fit"))
+}
+
+// Sign returns rawURL, a URL pathname with an optional query, with the
+// signature appended as a query parameter.
+func Sign(secret []byte, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	folder, imageID, ext, err := splitPath(u.Path)
+	if err != nil {
+		return "", err
+	}
+
+	sig := signature(secret, folder, imageID, ext, u.Query())
+	if u.RawQuery == "" {
+		return rawURL + "?" + Param + "=" + sig, nil
+	}
+	return rawURL + "&" + Param + "=" + sig, nil
+}
+
+// Verify reports whether the URL with pathname p and query q carries a valid
+// signature.
+func Verify(secret []byte, p string, q url.Values) bool {
+	folder, imageID, ext, err := splitPath(p)
+	if err != nil {
+		return false
+	}
+	want := signature(secret, folder, imageID, ext, q)
+	return hmac.Equal([]byte(want), []byte(q.Get(Param)))
+}
+
+func splitPath(p string) (folder, imageID, ext string, err error) {
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if len(parts) < 3 || parts[0] != "images" {
+		return "", "", "", ErrInvalidURL
+	}
+	file := parts[len(parts)-1]
+	ext = path.Ext(file)
+	return strings.Join(parts[1:len(parts)-1], "/"), strings.TrimSuffix(file, ext), ext, nil
+}
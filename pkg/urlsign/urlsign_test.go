@@ -0,0 +1,46 @@
+package urlsign
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	secret := []byte("secret")
+	list := []string{
+		"/images/1000/0123456789abcdef01234567.jpg?size=400x300&fit=cover",
+		"/images/1000/0123456789abcdef01234567?size=400",
+		"/images/1000/0123456789abcdef01234567.webp",
+		"/images/2022/03/14/0123456789abcdef01234567.jpg?size=400",
+		"/images/1000/0123456789abcdef01234567?preset=avatar",
+	}
+
+	for _, item := range list {
+		signed, err := Sign(secret, item)
+		if err != nil {
+			t.Fatalf("Sign(%v): %v", item, err)
+		}
+		u, _ := url.Parse(signed)
+		if !Verify(secret, u.Path, u.Query()) {
+			t.Fatalf("Verify(%v): want true, got false", signed)
+		}
+		if Verify([]byte("other"), u.Path, u.Query()) {
+			t.Fatalf("Verify(%v) with wrong secret: want false, got true", signed)
+		}
+
+		// Tamper with the size, or the preset of preset URLs.
+		q := u.Query()
+		if q.Get("preset") != "" {
+			q.Set("preset", "banner")
+		} else {
+			q.Set("size", "9999")
+		}
+		if Verify(secret, u.Path, q) {
+			t.Fatalf("Verify(%v) with tampered query: want false, got true", signed)
+		}
+	}
+
+	if _, err := Sign(secret, "/foo/bar"); err != ErrInvalidURL {
+		t.Fatalf("Sign(/foo/bar): want ErrInvalidURL, got %v", err)
+	}
+}
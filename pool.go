@@ -0,0 +1,122 @@
+package citra
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrBusy is returned when an image cannot be processed because the
+// processing queue is full.
+var ErrBusy = errors.New("too many images are being processed")
+
+// Pool limits the number of operations that process images, such as saving an
+// upload, that run at once. Operations beyond the limit wait in a queue, and
+// once the queue is full further operations fail with ErrBusy. An operation
+// takes a single slot however many images it processes, so that it is either
+// rejected before any work is done or runs to completion.
+type Pool struct {
+	slots      chan struct{}
+	queueDepth int
+
+	mu     sync.Mutex
+	active int
+	queued int
+	waited int64 // operations that got a slot, for AverageWait
+	stats  PoolStats
+}
+
+// PoolStats are statistics of a Pool.
+type PoolStats struct {
+	Concurrency int `json:"concurrency"`
+	QueueDepth  int `json:"queueDepth"`
+
+	// Number of operations running and waiting right now.
+	Active int `json:"active"`
+	Queued int `json:"queued"`
+
+	// Number of operations that ran to completion, that of those that returned
+	// an error, and that of operations rejected since the pool was created.
+	Processed int64 `json:"processed"`
+	Failed    int64 `json:"failed"`
+	Rejected  int64 `json:"rejected"`
+
+	// Time operations have waited in the queue, in seconds.
+	TotalWait   float64 `json:"totalWaitSeconds"`
+	AverageWait float64 `json:"averageWaitSeconds"`
+	MaxWait     float64 `json:"maxWaitSeconds"`
+}
+
+// NewPool returns a pool that runs at most concurrency operations at once and
+// queues at most queueDepth more.
+func NewPool(concurrency, queueDepth int) *Pool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if queueDepth < 0 {
+		queueDepth = 0
+	}
+	return &Pool{
+		slots:      make(chan struct{}, concurrency),
+		queueDepth: queueDepth,
+		stats:      PoolStats{Concurrency: concurrency, QueueDepth: queueDepth},
+	}
+}
+
+// Do runs f once a slot in p is free, and returns its error. If the queue is
+// full, f is not run and ErrBusy is returned. A nil Pool runs f right away.
+func (p *Pool) Do(f func() error) error {
+	if p == nil {
+		return f()
+	}
+
+	p.mu.Lock()
+	if p.active+p.queued >= cap(p.slots)+p.queueDepth {
+		p.stats.Rejected++
+		p.mu.Unlock()
+		return ErrBusy
+	}
+	p.queued++
+	p.mu.Unlock()
+
+	start := time.Now()
+	p.slots <- struct{}{}
+	wait := time.Since(start).Seconds()
+
+	p.mu.Lock()
+	p.queued--
+	p.active++
+	p.waited++
+	p.stats.TotalWait += wait
+	if wait > p.stats.MaxWait {
+		p.stats.MaxWait = wait
+	}
+	p.mu.Unlock()
+
+	var err error
+	defer func() {
+		p.mu.Lock()
+		p.active--
+		p.stats.Processed++
+		if err != nil {
+			p.stats.Failed++
+		}
+		p.mu.Unlock()
+		<-p.slots
+	}()
+
+	err = f()
+	return err
+}
+
+// Stats returns the current statistics of p.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.Active, s.Queued = p.active, p.queued
+	if p.waited > 0 {
+		s.AverageWait = s.TotalWait / float64(p.waited)
+	}
+	return s
+}
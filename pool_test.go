@@ -0,0 +1,59 @@
+package citra
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	p := NewPool(2, 1)
+
+	// Fill both slots and the queue.
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Do(func() error {
+				started <- struct{}{}
+				<-release
+				return nil
+			})
+		}()
+	}
+	<-started
+	<-started
+	for {
+		if s := p.Stats(); s.Active == 2 && s.Queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s := p.Stats(); s.Processed != 0 {
+		t.Fatalf("want running operations not counted as processed, got %v", s.Processed)
+	}
+
+	if err := p.Do(func() error { return nil }); err != ErrBusy {
+		t.Fatalf("Do with full queue: want ErrBusy, got %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+
+	s := p.Stats()
+	if s.Processed != 3 || s.Failed != 0 || s.Rejected != 1 || s.Active != 0 || s.Queued != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if err := p.Do(func() error { return nil }); err != nil {
+		t.Fatalf("Do with empty pool: %v", err)
+	}
+	if err := p.Do(func() error { return errInjected }); err != errInjected {
+		t.Fatalf("Do returning an error: want errInjected, got %v", err)
+	}
+	if s := p.Stats(); s.Processed != 5 || s.Failed != 1 {
+		t.Fatalf("unexpected stats after a failed operation %+v", s)
+	}
+}
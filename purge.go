@@ -0,0 +1,109 @@
+package citra
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"time"
+)
+
+// purgeBatchSize is the number of images fetched from DB at a time while
+// purging.
+const purgeBatchSize = 100
+
+// PurgeDeletedImages permanently removes, from deleted, the files of images
+// deleted before t, marks the images purged, and subtracts them from the
+// counts of their folders. deleted may be nil. It returns the number of images
+// purged.
+func PurgeDeletedImages(db *sql.DB, deleted Storage, t time.Time) (int, error) {
+	n := 0
+	for {
+		rows, err := db.Query(`select id, folder_id, type, size from images
+			where is_deleted = true and purged_at is null and deleted_at < ?
+			order by deleted_at limit ?`, t, purgeBatchSize)
+		if err != nil {
+			return n, err
+		}
+
+		var images []*DBImage
+		for rows.Next() {
+			image := &DBImage{}
+			if err = rows.Scan(&image.ID, &image.FolderID, &image.Type, &image.Size); err != nil {
+				rows.Close()
+				return n, err
+			}
+			images = append(images, image)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return n, err
+		}
+
+		if len(images) == 0 {
+			return n, nil
+		}
+
+		for _, image := range images {
+			if err = purgeImage(db, deleted, image); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+}
+
+// purgeImage removes the file of image before updating DB, so that if the
+// update fails the image is purged again the next time.
+func purgeImage(db *sql.DB, deleted Storage, image *DBImage) error {
+	if deleted != nil {
+		err := deleted.Delete(image.ID.String() + image.Type.Extension())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// The image may have been restored meanwhile.
+	res, err := tx.Exec("update images set purged_at = ? where id = ? and is_deleted = true and purged_at is null",
+		time.Now(), image.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback() // purged or restored concurrently
+		return err
+	}
+
+	_, err = tx.Exec(`update folders set images_count = images_count - 1, total_size = total_size - ?
+		where id = ?`, image.Size, image.FolderID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// purgeDeletedImagesEvery purges images deleted more than retention ago, every
+// interval, until ctx is done.
+func purgeDeletedImagesEvery(ctx context.Context, db *sql.DB, deleted Storage, retention, interval time.Duration) {
+	for {
+		n, err := PurgeDeletedImages(db, deleted, time.Now().Add(-retention))
+		if err != nil {
+			log.Println("Error purging deleted images:", err)
+		} else if n > 0 {
+			log.Println("Purged", n, "deleted images")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
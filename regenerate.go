@@ -0,0 +1,274 @@
+package citra
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/previnder/citra/pkg/luid"
+)
+
+// regenerateBatchSize is the number of images fetched from DB at a time while
+// regenerating copies.
+const regenerateBatchSize = 100
+
+// RegenerateArg is an argument to RegenerateCopies. Zero valued filters match
+// everything.
+type RegenerateArg struct {
+	// Only images with IDs greater than After are regenerated. Set it to the
+	// cursor of the last progress report to resume an interrupted run.
+	After luid.ID
+
+	// Only images in folders with IDs in this range (inclusive).
+	MinFolderID, MaxFolderID int
+
+	// Only images created in this time range.
+	CreatedAfter, CreatedBefore time.Time
+
+	// Only copies of this size, fit, and type.
+	Size ImageSize
+	Fit  ImageFit
+	Type ImageType
+
+	// Number of images processed concurrently. If less than 1, 1.
+	Workers int
+
+	// If true, nothing is written and the copies that would be regenerated are
+	// only counted.
+	DryRun bool
+
+	// If non-nil, Progress is called after each batch of images is done.
+	Progress func(RegenerateProgress)
+}
+
+// matches reports whether copy c matches the copy filters of arg. Variants
+// never do.
+func (arg *RegenerateArg) matches(c *ImageCopy) bool {
+	if c.Variant {
+		return false
+	}
+	if arg.Size.Width != 0 && (c.MaxWidth != arg.Size.Width || c.MaxHeight != arg.Size.Height) {
+		return false
+	}
+	if arg.Fit != "" && c.ImageFit != arg.Fit {
+		return false
+	}
+	return arg.Type == "" || c.Type.Extension() == arg.Type.Extension()
+}
+
+// RegenerateProgress is the progress of RegenerateCopies.
+type RegenerateProgress struct {
+	// Number of images done and the number of copies regenerated.
+	Images, Copies int
+
+	// Number of images that could not be regenerated.
+	Failed int
+
+	// All images with IDs up to and including Cursor are done.
+	Cursor luid.ID
+}
+
+// RegenerateCopies recreates the copies of non-deleted images from their
+// default images, as saveImageCopy does when they are first made, and updates
+// their dimensions and sizes in DB. Images are processed in the order of their
+// IDs. Errors with individual images are logged and counted as failed.
+//
+// Regenerating is NOT a way to repair default images, or copies made from bad
+// uploads: the original uploads are not kept, so copies are rebuilt from the
+// default images, which are already resized and lossily encoded, and default
+// images (and their variants) are never regenerated themselves. Regenerated
+// copies are never larger than the default image, and every run adds another
+// generation of encoding loss, so copies should only be regenerated once for
+// each change of resizing or encoder settings.
+func RegenerateCopies(db *sql.DB, store Storage, arg RegenerateArg) (RegenerateProgress, error) {
+	where := []string{"is_deleted = false", "id > ?"}
+	var args []interface{}
+	if arg.MinFolderID != 0 {
+		where = append(where, "folder_id >= ?")
+		args = append(args, arg.MinFolderID)
+	}
+	if arg.MaxFolderID != 0 {
+		where = append(where, "folder_id <= ?")
+		args = append(args, arg.MaxFolderID)
+	}
+	if !arg.CreatedAfter.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, arg.CreatedAfter)
+	}
+	if !arg.CreatedBefore.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, arg.CreatedBefore)
+	}
+	query := "select id from images where " + strings.Join(where, " and ") + " order by id limit ?"
+
+	workers := arg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	progress := RegenerateProgress{Cursor: arg.After}
+	for {
+		rows, err := db.Query(query, append(append([]interface{}{progress.Cursor}, args...), regenerateBatchSize)...)
+		if err != nil {
+			return progress, err
+		}
+
+		var IDs []luid.ID
+		for rows.Next() {
+			var ID luid.ID
+			if err = rows.Scan(&ID); err != nil {
+				rows.Close()
+				return progress, err
+			}
+			IDs = append(IDs, ID)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return progress, err
+		}
+
+		if len(IDs) == 0 {
+			return progress, nil
+		}
+
+		// The whole batch is done before the cursor moves past it, so that
+		// a run resumed from the cursor skips no image.
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		ch := make(chan luid.ID)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ID := range ch {
+					n, err := regenerateImage(db, store, ID, &arg)
+					mu.Lock()
+					if err != nil {
+						log.Println("Error regenerating copies of image", ID, ":", err)
+						progress.Failed++
+					} else {
+						progress.Images++
+						progress.Copies += n
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		for _, ID := range IDs {
+			ch <- ID
+		}
+		close(ch)
+		wg.Wait()
+
+		progress.Cursor = IDs[len(IDs)-1]
+		if arg.Progress != nil {
+			arg.Progress(progress)
+		}
+	}
+}
+
+// regenerateImage regenerates the copies of image with ID that match arg and
+// returns the number of copies regenerated (or that would be, if arg.DryRun).
+func regenerateImage(db *sql.DB, store Storage, ID luid.ID, arg *RegenerateArg) (int, error) {
+	image, err := GetImage(db, ID)
+	if err != nil {
+		return 0, err
+	}
+
+	var matched []*ImageCopy
+	for _, c := range image.Copies {
+		if arg.matches(c) {
+			matched = append(matched, c)
+		}
+	}
+	if len(matched) == 0 || arg.DryRun {
+		return len(matched), nil
+	}
+
+	buf, err := ReadFile(store, imageFilePath(image.Folder, ID.String()+image.Type.Extension()))
+	if err != nil {
+		return 0, err
+	}
+
+	// The new files are staged without holding a lock on the image, and
+	// replace the old ones only once the image is locked and known to be
+	// unchanged.
+	files := &stagedFiles{store: store}
+	var regenerated []*ImageCopy
+	for _, item := range matched {
+		c, data, err := makeImageCopy(buf, item.saveImageArg())
+		if err == nil {
+			c.Type = item.Type // keep empty types as they are
+			err = files.put(imageFilePath(image.Folder, c.Filename(ID.String())), data)
+		}
+		if err != nil {
+			files.cleanup()
+			return 0, err
+		}
+		regenerated = append(regenerated, c)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		files.cleanup()
+		return 0, err
+	}
+	// Files that replaced old ones are left in place on failure, as the old
+	// ones are gone.
+	fail := func(err error) (int, error) {
+		tx.Rollback()
+		files.discard()
+		return 0, err
+	}
+
+	var folderID int
+	var isDeleted bool
+	var copiesJSON []byte
+	row := tx.QueryRow("select folder_id, is_deleted, copies from images where id = ? for update", ID)
+	if err = row.Scan(&folderID, &isDeleted, &copiesJSON); err != nil {
+		return fail(err)
+	}
+	if folderID != image.FolderID {
+		return fail(errImageMoved)
+	}
+	if isDeleted {
+		return fail(ErrImageDeleted)
+	}
+	var copies []*ImageCopy
+	if err = json.Unmarshal(copiesJSON, &copies); err != nil {
+		return fail(errors.New("error unmarshaling copies: " + err.Error()))
+	}
+
+	// Other copies may have been added meanwhile and are kept as they are.
+	// If a regenerated copy was removed, its file must not be recreated.
+	for _, c := range regenerated {
+		found := false
+		for i, item := range copies {
+			if item.isCopyOf(c.saveImageArg()) {
+				copies[i], found = c, true
+			}
+		}
+		if !found {
+			return fail(errors.New("copies of image were removed concurrently"))
+		}
+	}
+
+	copiesJSON, _ = json.Marshal(copies)
+	if _, err = tx.Exec("update images set copies = ? where id = ?", copiesJSON, ID); err != nil {
+		return fail(err)
+	}
+
+	if err = files.commit(); err != nil {
+		return fail(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	return len(regenerated), nil
+}
@@ -0,0 +1,86 @@
+package citra
+
+import "testing"
+
+func TestRegenerateArgMatches(t *testing.T) {
+	c := &ImageCopy{MaxWidth: 400, MaxHeight: 300, ImageFit: ImageFitCover, Type: ImageTypeWEBP}
+	jpeg := &ImageCopy{MaxWidth: 400, MaxHeight: 300, ImageFit: ImageFitCover} // saved before types
+
+	list := []struct {
+		arg  RegenerateArg
+		c    *ImageCopy
+		want bool
+	}{
+		{RegenerateArg{}, c, true},
+		{RegenerateArg{Size: ImageSize{400, 300}}, c, true},
+		{RegenerateArg{Size: ImageSize{400, 400}}, c, false},
+		{RegenerateArg{Size: ImageSize{400, 300}, Fit: ImageFitCover}, c, true},
+		{RegenerateArg{Fit: ImageFitContain}, c, false},
+		{RegenerateArg{Type: ImageTypeWEBP}, c, true},
+		{RegenerateArg{Type: ImageTypeJPEG}, c, false},
+		{RegenerateArg{Type: ImageTypeJPEG}, jpeg, true},
+		{RegenerateArg{Type: ImageTypeWEBP}, jpeg, false},
+	}
+
+	for _, item := range list {
+		if got := item.arg.matches(item.c); got != item.want {
+			t.Fatalf("%+v matches %+v: want %v, got %v", item.arg, *item.c, item.want, got)
+		}
+	}
+}
+
+func TestRegenerateCopies(t *testing.T) {
+	db := openTestDB(t)
+	store := &DiskStorage{Root: t.TempDir()}
+	copies := []SaveImageArg{
+		{MaxWidth: 64, MaxHeight: 64, ImageFit: ImageFitContain, IsDefault: true},
+		{MaxWidth: 32, MaxHeight: 32, ImageFit: ImageFitCover, Type: ImageTypeWEBP},
+	}
+
+	image, err := SaveImage(db, store, FolderLayout{}, testJPEG(t), copies, "")
+	if err != nil {
+		t.Fatal("SaveImage: ", err)
+	}
+	name := imageFilePath(image.Folder, image.Copies[0].Filename(image.ID.String()))
+	if err = store.Put(name, []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Images of other tests may be created meanwhile, and fail to regenerate
+	// as their files are gone, so only this image is checked.
+	arg := RegenerateArg{CreatedAfter: image.CreatedAt, Size: ImageSize{32, 32}, Fit: ImageFitCover, DryRun: true}
+	progress, err := RegenerateCopies(db, store, arg)
+	if err != nil {
+		t.Fatal("RegenerateCopies: ", err)
+	}
+	if progress.Copies < 1 {
+		t.Fatalf("dry run: want at least 1 copy, got %+v", progress)
+	}
+	if data, _ := ReadFile(store, name); string(data) != "stale" {
+		t.Fatalf("dry run: copy was written")
+	}
+
+	arg.DryRun = false
+	if _, err = RegenerateCopies(db, store, arg); err != nil {
+		t.Fatal("RegenerateCopies: ", err)
+	}
+	data, err := ReadFile(store, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	width, height, err := GetImageSize(data)
+	if err != nil {
+		t.Fatal("GetImageSize of regenerated copy: ", err)
+	}
+	if width != 32 || height != 32 {
+		t.Fatalf("want regenerated copy of 32x32, got %dx%d", width, height)
+	}
+
+	image, err = GetImage(db, image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := image.Copies[0]; c.Size != len(data) || c.Type != ImageTypeWEBP {
+		t.Fatalf("want copy of size %d in DB, got %+v", len(data), *c)
+	}
+}
@@ -0,0 +1,397 @@
+package citra
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/previnder/citra/pkg/s3"
+)
+
+// Storage stores image files. Names are slash separated paths relative to the
+// root of the storage, for example "1000/{imageID}.jpg".
+//
+// Errors returned for files that do not exist satisfy os.IsNotExist.
+type Storage interface {
+	// Put creates or replaces file name with data. A file is either written
+	// completely or not at all.
+	Put(name string, data []byte) error
+
+	// Open opens file name for reading. The returned file supports seeking, so
+	// that it can be used to serve range requests.
+	Open(name string) (File, error)
+
+	// Stat returns information about file name.
+	Stat(name string) (os.FileInfo, error)
+
+	// Delete deletes file name.
+	Delete(name string) error
+
+	// Rename renames file oldName to newName, replacing newName if it exists.
+	Rename(oldName, newName string) error
+
+	// DeletePrefix deletes all files whose names begin with prefix and returns
+	// the number of files deleted. If an error is encountered the number of
+	// files deleted up to that point is returned.
+	DeletePrefix(prefix string) (int, error)
+
+	// List returns the names of all files whose names begin with prefix.
+	List(prefix string) ([]string, error)
+}
+
+// File is a file opened from a Storage.
+type File interface {
+	io.ReadSeekCloser
+	Stat() (os.FileInfo, error)
+}
+
+// ReadFile reads the whole of file name from s.
+func ReadFile(s Storage, name string) ([]byte, error) {
+	file, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// Storage types.
+const (
+	StorageTypeDisk = "disk"
+	StorageTypeS3   = "s3"
+)
+
+// NewStorage returns the storage for images and the storage for deleted images
+// as specified in c. Deleted storage is nil if deleted images are not to be
+// kept.
+func NewStorage(c *Config) (Storage, Storage, error) {
+	switch c.Storage.Type {
+	case "", StorageTypeDisk:
+		var deleted Storage
+		if c.DeletedDir != "" {
+			deleted = &DiskStorage{Root: c.DeletedDir}
+		}
+		return &DiskStorage{Root: c.RootUploadsDir}, deleted, nil
+	case StorageTypeS3:
+		client := &s3.Client{
+			Endpoint:  c.Storage.S3.Endpoint,
+			Region:    c.Storage.S3.Region,
+			Bucket:    c.Storage.S3.Bucket,
+			AccessKey: c.Storage.S3.AccessKey,
+			SecretKey: c.Storage.S3.SecretKey,
+		}
+		var deleted Storage
+		if c.Storage.S3.DeletedPrefix != "" {
+			deleted = &S3Storage{Client: client, Prefix: c.Storage.S3.DeletedPrefix}
+		}
+		return &S3Storage{Client: client, Prefix: c.Storage.S3.Prefix}, deleted, nil
+	}
+	return nil, nil, errors.New("unknown storage type: " + c.Storage.Type)
+}
+
+// DiskStorage stores files in directory Root on the local filesystem.
+type DiskStorage struct {
+	Root string
+}
+
+func (d *DiskStorage) path(name string) string {
+	return filepath.Join(d.Root, filepath.FromSlash(name))
+}
+
+// Put implements Storage interface. Parent directories are created as needed.
+// Data is written to a temporary file in the same directory, synced, and then
+// renamed to name, so that a crash never leaves a partially written file.
+func (d *DiskStorage) Put(name string, data []byte) error {
+	p := d.path(name)
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(dir, "."+filepath.Base(p)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0755)
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Open implements Storage interface.
+func (d *DiskStorage) Open(name string) (File, error) {
+	f, err := os.Open(d.path(name))
+	if err != nil {
+		return nil, err // not a nil *os.File in a non-nil File
+	}
+	return f, nil
+}
+
+// Stat implements Storage interface.
+func (d *DiskStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(d.path(name))
+}
+
+// Delete implements Storage interface.
+func (d *DiskStorage) Delete(name string) error {
+	return os.Remove(d.path(name))
+}
+
+// Rename implements Storage interface.
+func (d *DiskStorage) Rename(oldName, newName string) error {
+	p := d.path(newName)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(d.path(oldName), p); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(p))
+}
+
+// syncDir syncs directory dir, so that changes to its entries (files created or
+// renamed) survive a crash.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// DeletePrefix implements Storage interface. Only files in the directory of
+// prefix are deleted, not files in its subdirectories.
+func (d *DiskStorage) DeletePrefix(prefix string) (int, error) {
+	dir, base := path.Split(prefix)
+	return deleteFilesByPrefix(d.path(dir), base)
+}
+
+// List implements Storage interface. Only files in the directory of prefix are
+// listed, not files in its subdirectories. Listing a directory that does not
+// exist returns no files.
+func (d *DiskStorage) List(prefix string) ([]string, error) {
+	dir, base := path.Split(prefix)
+	file, err := os.Open(d.path(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	infos, err := file.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasPrefix(info.Name(), base) {
+			names = append(names, dir+info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// deleteFilesByPrefix deletes all files in dir with filename prefix s and
+// returns the number of files deleted. If an error is encounted no of files
+// deleted up to that point is returned.
+func deleteFilesByPrefix(dir, s string) (int, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	names, err := file.Readdirnames(0)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, name := range names {
+		if strings.HasPrefix(name, s) {
+			if err = os.Remove(filepath.Join(dir, name)); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// S3Storage stores files as objects in an S3 compatible bucket. Object keys
+// are file names prepended with Prefix.
+type S3Storage struct {
+	Client *s3.Client
+	Prefix string
+}
+
+func s3Error(op, name string, err error) error {
+	if err == s3.ErrNotFound {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// Put implements Storage interface.
+func (s *S3Storage) Put(name string, data []byte) error {
+	return s3Error("put", name, s.Client.PutObject(s.Prefix+name, data, mime.TypeByExtension(path.Ext(name))))
+}
+
+// Open implements Storage interface.
+func (s *S3Storage) Open(name string) (File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{client: s.Client, key: s.Prefix + name, info: info.(*s3FileInfo)}, nil
+}
+
+// Stat implements Storage interface.
+func (s *S3Storage) Stat(name string) (os.FileInfo, error) {
+	info, err := s.Client.HeadObject(s.Prefix + name)
+	if err != nil {
+		return nil, s3Error("stat", name, err)
+	}
+	return &s3FileInfo{name: path.Base(name), size: info.Size, modTime: info.LastModified}, nil
+}
+
+// Delete implements Storage interface.
+func (s *S3Storage) Delete(name string) error {
+	return s3Error("delete", name, s.Client.DeleteObject(s.Prefix+name))
+}
+
+// Rename implements Storage interface. The object is copied to its new key and
+// the old object deleted.
+func (s *S3Storage) Rename(oldName, newName string) error {
+	if err := s.Client.CopyObject(s.Prefix+oldName, s.Prefix+newName); err != nil {
+		return s3Error("rename", oldName, err)
+	}
+	return s3Error("rename", oldName, s.Client.DeleteObject(s.Prefix+oldName))
+}
+
+// DeletePrefix implements Storage interface.
+func (s *S3Storage) DeletePrefix(prefix string) (int, error) {
+	objects, err := s.Client.ListObjects(s.Prefix + prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, item := range objects {
+		if err = s.Client.DeleteObject(item.Key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// List implements Storage interface.
+func (s *S3Storage) List(prefix string) ([]string, error) {
+	objects, err := s.Client.ListObjects(s.Prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(objects))
+	for i, item := range objects {
+		names[i] = strings.TrimPrefix(item.Key, s.Prefix)
+	}
+	return names, nil
+}
+
+// s3File is an object opened for reading. The object is fetched lazily, with a
+// ranged request starting at the current offset, so that seeking is cheap.
+type s3File struct {
+	client *s3.Client
+	key    string
+	info   *s3FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.client.GetObject(f.key, f.offset)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative offset")
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i *s3FileInfo) Name() string       { return i.name }
+func (i *s3FileInfo) Size() int64        { return i.size }
+func (i *s3FileInfo) Mode() os.FileMode  { return 0644 }
+func (i *s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i *s3FileInfo) IsDir() bool        { return false }
+func (i *s3FileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,45 @@
+package citra
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDiskStorage(t *testing.T) {
+	store := &DiskStorage{Root: t.TempDir()}
+
+	names := []string{"1000/a.jpg", "1000/a_400_400_cover.jpg", "1000/b.jpg"}
+	for _, name := range names {
+		if err := store.Put(name, []byte(name)); err != nil {
+			t.Fatalf("Put(%v): %v", name, err)
+		}
+	}
+
+	data, err := ReadFile(store, "1000/b.jpg")
+	if err != nil || string(data) != "1000/b.jpg" {
+		t.Fatalf("ReadFile: got %q (error: %v)", data, err)
+	}
+
+	if err = store.Rename("1000/b.jpg", "1001/b.jpg"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err = store.Stat("1001/b.jpg"); err != nil {
+		t.Fatalf("Stat of renamed file: %v", err)
+	}
+
+	list, err := store.List("1000/a")
+	if err != nil || len(list) != 2 || list[0] != "1000/a.jpg" {
+		t.Fatalf("List: got %v (error: %v)", list, err)
+	}
+
+	n, err := store.DeletePrefix("1000/a")
+	if err != nil || n != 2 {
+		t.Fatalf("DeletePrefix: want 2 files deleted, got %v (error: %v)", n, err)
+	}
+	if _, err = store.Stat("1000/a.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of deleted file: want not exist error, got %v", err)
+	}
+	if f, err := store.Open("1000/c.jpg"); f != nil || !os.IsNotExist(err) {
+		t.Fatalf("Open of missing file: want nil file and not exist error, got %v (error: %v)", f, err)
+	}
+}
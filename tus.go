@@ -0,0 +1,360 @@
+package citra
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/previnder/citra/pkg/luid"
+)
+
+// tusVersion is the version of the tus resumable upload protocol supported.
+const tusVersion = "1.0.0"
+
+// tusExtensions are the extensions of the tus protocol supported.
+const tusExtensions = "creation,expiration,termination"
+
+var (
+	// errUploadOffset is returned when a chunk is written to a partial upload
+	// at an offset other than the size of the upload so far.
+	errUploadOffset = errors.New("upload offset mismatch")
+
+	// errUploadLocked is returned when a partial upload is being written by
+	// another request, or was while it was thought to be locked.
+	errUploadLocked = errors.New("upload is locked")
+
+	errInvalidUploadMetadata = errors.New("invalid upload metadata")
+)
+
+// partialUpload is an upload, made with the tus protocol, that may not be
+// complete yet.
+type partialUpload struct {
+	ID luid.ID `json:"id"`
+
+	// Total size of the upload.
+	Length int64 `json:"length"`
+
+	// Parameters of the upload, from its metadata.
+	Request uploadRequest `json:"request"`
+
+	// Number of bytes received so far.
+	Offset int64 `json:"-"`
+
+	// When the last chunk was received.
+	UpdatedAt time.Time `json:"-"`
+}
+
+// Complete reports whether all of u is received.
+func (u *partialUpload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// partialUploads stores partial uploads, so that they can be resumed on any
+// server sharing the DB and the Storage. The state of each upload is a record
+// in partial_uploads table, and the data received is stored in the Storage, one
+// file per chunk, under tus/{ID}/.
+type partialUploads struct {
+	db      *sql.DB
+	store   Storage
+	tempDir string // for chunks being received, see tempUpload
+}
+
+// partialUploadLockTimeout is how long a partial upload stays locked by a
+// request, which may have died, unless it is unlocked.
+const partialUploadLockTimeout = 15 * time.Minute
+
+func newPartialUploads(db *sql.DB, store Storage, tempDir string) *partialUploads {
+	return &partialUploads{db: db, store: store, tempDir: tempDir}
+}
+
+// chunksPrefix returns the prefix of the names of the chunks of the upload
+// with ID.
+func (p *partialUploads) chunksPrefix(ID luid.ID) string {
+	return "tus/" + ID.String() + "/"
+}
+
+// chunkName returns the name of the chunk of the upload with ID that starts at
+// offset. Names sort in the order of their offsets.
+func (p *partialUploads) chunkName(ID luid.ID, offset int64) string {
+	s := strconv.FormatInt(offset, 10)
+	return p.chunksPrefix(ID) + strings.Repeat("0", 20-len(s)) + s
+}
+
+// create creates an empty partial upload of length bytes.
+func (p *partialUploads) create(length int64, req uploadRequest) (*partialUpload, error) {
+	ID, now := luid.New()
+	u := &partialUpload{ID: ID, Length: length, Request: req, UpdatedAt: now}
+	reqJSON, _ := json.Marshal(req)
+	_, err := p.db.Exec("insert into partial_uploads (id, length, request, updated_at) values (?, ?, ?, ?)",
+		ID, length, reqJSON, now)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// get returns the partial upload with ID. If there is no such upload, the
+// error satisfies os.IsNotExist.
+func (p *partialUploads) get(ID luid.ID) (*partialUpload, error) {
+	u := &partialUpload{ID: ID}
+	var req []byte
+	row := p.db.QueryRow("select length, request, received, updated_at from partial_uploads where id = ?", ID)
+	if err := row.Scan(&u.Length, &req, &u.Offset, &u.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			err = os.ErrNotExist
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(req, &u.Request); err != nil {
+		return nil, errors.New("error unmarshaling request: " + err.Error())
+	}
+	return u, nil
+}
+
+// lock locks the partial upload with ID against concurrent writes, by
+// requests to any server, and returns the token with which it is unlocked. It
+// returns errUploadLocked if the upload is already locked, and an error that
+// satisfies os.IsNotExist if there is no such upload.
+func (p *partialUploads) lock(ID luid.ID) (string, error) {
+	token, now := luid.New()
+	res, err := p.db.Exec(`update partial_uploads set locked_by = ?, locked_at = ?
+		where id = ? and (locked_by is null or locked_at < ?)`,
+		token.String(), now, ID, now.Add(-partialUploadLockTimeout))
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 1 {
+		return token.String(), nil
+	}
+
+	var exists bool
+	if err = p.db.QueryRow("select count(*) > 0 from partial_uploads where id = ?", ID).Scan(&exists); err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", os.ErrNotExist
+	}
+	return "", errUploadLocked
+}
+
+// unlock unlocks the partial upload with ID, locked with token.
+func (p *partialUploads) unlock(ID luid.ID, token string) {
+	_, err := p.db.Exec("update partial_uploads set locked_by = null, locked_at = null where id = ? and locked_by = ?", ID, token)
+	if err != nil {
+		log.Println("Error unlocking upload", ID, ":", err)
+	}
+}
+
+// write appends the chunk in r, which starts at offset, to u, which must be
+// locked with token. The chunk is cut at the length of u. Whatever is read of
+// r is kept, even if an error is returned, and u.Offset is updated
+// accordingly. If the lock was lost, errUploadLocked is returned and nothing
+// is kept.
+func (p *partialUploads) write(u *partialUpload, token string, offset int64, r io.Reader) error {
+	if offset != u.Offset {
+		return errUploadOffset
+	}
+
+	f, err := ioutil.TempFile(p.tempDir, "citra-chunk-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	n, err := io.Copy(f, io.LimitReader(r, u.Length-u.Offset))
+	if n == 0 {
+		return err
+	}
+
+	// A chunk stored at an offset that is not then recorded is replaced by
+	// the next chunk written at that offset.
+	buf, err2 := mapFile(f, int(n))
+	if err2 != nil {
+		return err2
+	}
+	err2 = p.store.Put(p.chunkName(u.ID, offset), buf)
+	unmapFile(buf)
+	if err2 != nil {
+		return err2
+	}
+
+	now := time.Now()
+	res, err2 := p.db.Exec("update partial_uploads set received = received + ?, updated_at = ? where id = ? and received = ? and locked_by = ?",
+		n, now, u.ID, offset, token)
+	if err2 != nil {
+		return err2
+	}
+	if rows, err2 := res.RowsAffected(); err2 != nil {
+		return err2
+	} else if rows == 0 {
+		return errUploadLocked
+	}
+
+	u.Offset += n
+	u.UpdatedAt = now
+	return err
+}
+
+// read calls f with the contents of u, which must be complete. The contents
+// are valid only until f returns.
+func (p *partialUploads) read(u *partialUpload, f func([]byte) error) error {
+	names, err := p.store.List(p.chunksPrefix(u.ID))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	// Each chunk must start where the previous one ends.
+	var readers []io.Reader
+	var size int64
+	for _, name := range names {
+		offset, err := strconv.ParseInt(strings.TrimPrefix(name, p.chunksPrefix(u.ID)), 10, 64)
+		if err != nil || offset >= u.Length {
+			continue // a chunk that was never recorded
+		}
+		file, err := p.store.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if offset != size {
+			return errors.New("chunks of upload " + u.ID.String() + " are not contiguous")
+		}
+		readers = append(readers, file)
+		size += info.Size()
+	}
+	if size < u.Length {
+		return errors.New("upload " + u.ID.String() + " is missing chunks")
+	}
+
+	upload, err := newTempUpload(io.LimitReader(io.MultiReader(readers...), u.Length), p.tempDir, u.Length)
+	if err != nil {
+		return err
+	}
+	defer upload.Close()
+
+	return f(upload.Bytes())
+}
+
+// remove removes the partial upload with ID.
+func (p *partialUploads) remove(ID luid.ID) error {
+	res, err := p.db.Exec("delete from partial_uploads where id = ?", ID)
+	if err != nil {
+		return err
+	}
+	if _, err = p.store.DeletePrefix(p.chunksPrefix(ID)); err != nil {
+		log.Println("Error deleting chunks of upload", ID, ":", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// expire removes partial uploads that received no chunk since before, unless
+// they are locked, and returns the number of uploads removed.
+func (p *partialUploads) expire(before time.Time) (int, error) {
+	rows, err := p.db.Query("select id from partial_uploads where updated_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	var IDs []luid.ID
+	for rows.Next() {
+		var ID luid.ID
+		if err = rows.Scan(&ID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		IDs = append(IDs, ID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, ID := range IDs {
+		token, err := p.lock(ID)
+		if err != nil {
+			if err == errUploadLocked || os.IsNotExist(err) {
+				continue
+			}
+			return n, err
+		}
+		// A chunk may have been received since the upload was listed.
+		u, err := p.get(ID)
+		if err == nil && !u.UpdatedAt.Before(before) {
+			p.unlock(ID, token)
+			continue
+		}
+		if err = p.remove(ID); err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// expirePartialUploadsEvery removes partial uploads in p older than maxAge
+// every interval, until ctx is done.
+func expirePartialUploadsEvery(ctx context.Context, p *partialUploads, maxAge, interval time.Duration) {
+	for {
+		n, err := p.expire(time.Now().Add(-maxAge))
+		if err != nil {
+			log.Println("Error expiring partial uploads:", err)
+		} else if n > 0 {
+			log.Println("Expired", n, "partial uploads")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// parseUploadMetadata parses the value of tus header Upload-Metadata: comma
+// separated pairs of keys and base64 encoded values, separated by a space.
+// Values may be omitted.
+func parseUploadMetadata(header string) (url.Values, error) {
+	v := url.Values{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.Split(pair, " ")
+		if len(parts) > 2 || parts[0] == "" {
+			return nil, errInvalidUploadMetadata
+		}
+		var value []byte
+		if len(parts) == 2 {
+			var err error
+			if value, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+				return nil, errInvalidUploadMetadata
+			}
+		}
+		v.Set(parts[0], string(value))
+	}
+	return v, nil
+}
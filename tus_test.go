@@ -0,0 +1,103 @@
+package citra
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/previnder/citra/pkg/luid"
+)
+
+func TestPartialUploads(t *testing.T) {
+	db := openTestDB(t)
+	store := &DiskStorage{Root: t.TempDir()}
+	p := newPartialUploads(db, store, t.TempDir())
+	u, err := p.create(10, uploadRequest{Preset: "avatar"})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	token, err := p.lock(u.ID)
+	if err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if _, err = p.lock(u.ID); err != errUploadLocked {
+		t.Fatalf("want errUploadLocked, got %v", err)
+	}
+	if _, err = p.lock(luid.ID{}); !os.IsNotExist(err) {
+		t.Fatalf("lock of missing upload: want not exist error, got %v", err)
+	}
+
+	if err = p.write(u, token, 0, bytes.NewReader([]byte("01234"))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err = p.write(u, token, 3, bytes.NewReader([]byte("56789"))); err != errUploadOffset {
+		t.Fatalf("want errUploadOffset, got %v", err)
+	}
+	p.unlock(u.ID, token)
+
+	// Writes by a request that no longer holds the lock are not kept.
+	if err = p.write(u, token, 5, bytes.NewReader([]byte("56789"))); err != errUploadLocked {
+		t.Fatalf("write after unlock: want errUploadLocked, got %v", err)
+	}
+
+	// Bytes past the length of the upload are discarded.
+	u, err = p.get(u.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if u.Offset != 5 || u.Length != 10 || u.Request.Preset != "avatar" {
+		t.Fatalf("unexpected upload %+v", u)
+	}
+	if token, err = p.lock(u.ID); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if err = p.write(u, token, 5, bytes.NewReader([]byte("56789abc"))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !u.Complete() {
+		t.Fatalf("want upload complete, offset is %d", u.Offset)
+	}
+	p.unlock(u.ID, token)
+
+	err = p.read(u, func(buf []byte) error {
+		if string(buf) != "0123456789" {
+			t.Fatalf("want contents 0123456789, got %q", buf)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if n, err := p.expire(time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("expire: want 0 removed, got %d, %v", n, err)
+	}
+	if n, err := p.expire(time.Now().Add(time.Hour)); err != nil || n < 1 {
+		t.Fatalf("expire: want at least 1 removed, got %d, %v", n, err)
+	}
+	if _, err = p.get(u.ID); !os.IsNotExist(err) {
+		t.Fatalf("want expired upload gone, got %v", err)
+	}
+	if names, _ := store.List(p.chunksPrefix(u.ID)); len(names) != 0 {
+		t.Fatalf("want chunks of expired upload deleted, got %v", names)
+	}
+}
+
+func TestParseUploadMetadata(t *testing.T) {
+	v, err := parseUploadMetadata("preset YXZhdGFy, async dHJ1ZQ==,empty")
+	if err != nil {
+		t.Fatalf("parseUploadMetadata: %v", err)
+	}
+	if v.Get("preset") != "avatar" || v.Get("async") != "true" {
+		t.Fatalf("unexpected metadata %v", v)
+	}
+	if _, ok := v["empty"]; !ok {
+		t.Fatalf("want key without value, got %v", v)
+	}
+
+	if _, err = parseUploadMetadata("preset not-base64!"); err != errInvalidUploadMetadata {
+		t.Fatalf("want errInvalidUploadMetadata, got %v", err)
+	}
+}
@@ -0,0 +1,344 @@
+package citra
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ErrUploadTooLarge is returned when an upload exceeds the maximum upload
+// size.
+var ErrUploadTooLarge = errors.New("upload too large")
+
+// maxFormValueSize is the maximum size of a form value, other than the image,
+// in an upload.
+const maxFormValueSize = 1 << 20
+
+// tempUpload is an upload streamed to a temporary file. Its contents are
+// mapped into memory rather than read, so that they are paged in from the file
+// as libvips reads them and do not count towards the heap.
+type tempUpload struct {
+	file *os.File
+	buf  []byte
+}
+
+// newTempUpload streams r to a temporary file in dir (or the default directory
+// for temporary files, if dir is empty). If more than limit bytes are read,
+// ErrUploadTooLarge is returned. The upload must be closed.
+func newTempUpload(r io.Reader, dir string, limit int64) (*tempUpload, error) {
+	f, err := ioutil.TempFile(dir, "citra-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	u := &tempUpload{file: f}
+
+	n, err := io.Copy(f, io.LimitReader(r, limit+1))
+	if err == nil && n > limit {
+		err = ErrUploadTooLarge
+	}
+	if err == nil {
+		u.buf, err = mapFile(f, int(n))
+	}
+	if err != nil {
+		u.Close()
+		if strings.Contains(err.Error(), "request body too large") {
+			err = ErrUploadTooLarge
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+// Bytes returns the contents of u. They are valid only until u is closed.
+func (u *tempUpload) Bytes() []byte {
+	return u.buf
+}
+
+// Close releases the contents of u and removes its file.
+func (u *tempUpload) Close() error {
+	err := unmapFile(u.buf)
+	u.buf = nil
+	if err2 := u.file.Close(); err == nil {
+		err = err2
+	}
+	if err2 := os.Remove(u.file.Name()); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// errFormValueTooLarge is returned for an upload with a form value larger than
+// maxFormValueSize.
+var errFormValueTooLarge = errors.New("form value too large")
+
+// readMultipartUpload streams a multipart/form-data upload from mr. The part
+// named "image" is streamed to a temporary file in dir, and is at most limit
+// bytes; other parts are returned as form values. The returned upload is nil
+// if there is no image part.
+func readMultipartUpload(mr *multipart.Reader, dir string, limit int64) (*tempUpload, url.Values, error) {
+	var upload *tempUpload
+	form := url.Values{}
+	fail := func(err error) (*tempUpload, url.Values, error) {
+		if upload != nil {
+			upload.Close()
+		}
+		if strings.Contains(err.Error(), "request body too large") {
+			err = ErrUploadTooLarge
+		}
+		return nil, nil, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		name := part.FormName()
+		if name == "image" {
+			if upload != nil {
+				part.Close()
+				return fail(errors.New("more than one image in upload"))
+			}
+			upload, err = newTempUpload(part, dir, limit)
+		} else if name != "" {
+			var value []byte
+			value, err = ioutil.ReadAll(io.LimitReader(part, maxFormValueSize+1))
+			if err == nil && len(value) > maxFormValueSize {
+				err = errFormValueTooLarge
+			}
+			form.Add(name, string(value))
+		}
+		part.Close()
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	return upload, form, nil
+}
+
+// errInvalidUploadJSON is returned for a malformed JSON upload.
+var errInvalidUploadJSON = errors.New("invalid json")
+
+// readJSONUpload reads a JSON upload request from r. The image, base64
+// encoded, is decoded as it is read and streamed to a temporary file in dir,
+// and is at most limit bytes; only the other fields are held in memory. The
+// returned upload is nil if there is no image.
+func readJSONUpload(r io.Reader, dir string, limit int64) (*tempUpload, *uploadRequest, error) {
+	var upload *tempUpload
+	fail := func(err error) (*tempUpload, *uploadRequest, error) {
+		if upload != nil {
+			upload.Close()
+		}
+		switch err.(type) {
+		case *json.SyntaxError, *json.UnmarshalTypeError, base64.CorruptInputError:
+			err = errInvalidUploadJSON
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errInvalidUploadJSON
+		} else if strings.Contains(err.Error(), "request body too large") {
+			err = ErrUploadTooLarge
+		}
+		return nil, nil, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		if err == nil {
+			err = errInvalidUploadJSON
+		}
+		return fail(err)
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return fail(err)
+		}
+		key, _ := t.(string)
+		if !strings.EqualFold(key, "image") {
+			var value json.RawMessage
+			if err = dec.Decode(&value); err != nil {
+				return fail(err)
+			}
+			fields[key] = value
+			continue
+		}
+		if upload != nil {
+			return fail(errInvalidUploadJSON)
+		}
+
+		// The image is read past the decoder, which is then resumed after it
+		// as if the image were null.
+		br := bufio.NewReader(io.MultiReader(dec.Buffered(), r))
+		if err = readJSONStringStart(br); err != nil {
+			return fail(err)
+		}
+		// The decoder skips line breaks, so the raw string is limited too:
+		// to 3 times the encoded limit, enough for every character escaped
+		// and line breaks, plus the closing quote.
+		raw := &jsonStringReader{r: br, left: 3*((limit+2)/3*4) + 1}
+		value := base64.NewDecoder(base64.StdEncoding, raw)
+		if upload, err = newTempUpload(value, dir, limit); err != nil {
+			return fail(err)
+		}
+		dec = json.NewDecoder(io.MultiReader(strings.NewReader(`{"image":null`), br))
+		for i := 0; i < 3; i++ {
+			dec.Token()
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fail(err)
+	}
+
+	data, _ := json.Marshal(fields)
+	req := &uploadRequest{}
+	if err := json.Unmarshal(data, req); err != nil {
+		return fail(err)
+	}
+	if upload != nil {
+		req.Image = upload.Bytes()
+	}
+	return upload, req, nil
+}
+
+// readJSONStringStart reads from r up to and including the opening quote of the
+// string value of an object key just read.
+func readJSONStringStart(r *bufio.Reader) error {
+	colon := false
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		case c == ':' && !colon:
+			colon = true
+		case c == '"' && colon:
+			return nil
+		default:
+			return errInvalidUploadJSON
+		}
+	}
+}
+
+// jsonStringReader reads the contents of a JSON string, whose opening quote has
+// been read, up to its closing quote. Only the escapes that may occur in
+// base64 encoded values are supported. At most left bytes of the string,
+// counted before unescaping, are read; beyond that ErrUploadTooLarge is
+// returned.
+type jsonStringReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func (s *jsonStringReader) readByte() (byte, error) {
+	if s.left <= 0 {
+		return 0, ErrUploadTooLarge
+	}
+	s.left--
+	return s.r.ReadByte()
+}
+
+func (s *jsonStringReader) Read(p []byte) (int, error) {
+	if s.done {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) {
+		c, err := s.readByte()
+		if err != nil {
+			return n, err
+		}
+		switch {
+		case c == '"':
+			s.done = true
+			return n, io.EOF
+		case c == '\\':
+			if c, err = s.readByte(); err != nil {
+				return n, err
+			}
+			switch c {
+			case '/':
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			default:
+				return n, errInvalidUploadJSON
+			}
+		case c < 0x20:
+			return n, errInvalidUploadJSON
+		}
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
+
+// uploadRequest is an upload of an image, in any of the forms addImage
+// accepts.
+type uploadRequest struct {
+	// The image. Base64 encoded in JSON.
+	Image []byte `json:"image"`
+
+	// Either Copies or Preset must be given.
+	Copies []SaveImageArg `json:"copies"`
+	Preset string         `json:"preset"`
+
+	// If true, the image is saved in the background.
+	Async bool `json:"async"`
+}
+
+// uploadRequestFromValues returns the upload request, without the image, in
+// form or query values v. Copies are JSON.
+func uploadRequestFromValues(v url.Values) (*uploadRequest, error) {
+	req := &uploadRequest{
+		Preset: v.Get("preset"),
+		Async:  v.Get("async") == "true",
+	}
+	if copies := v.Get("copies"); copies != "" {
+		if err := json.Unmarshal([]byte(copies), &req.Copies); err != nil {
+			return nil, errInvalidUploadJSON
+		}
+	}
+	return req, nil
+}
+
+// Errors of upload requests with invalid copies.
+var (
+	errCopiesAndPreset = errors.New("only one of copies and preset may be given")
+	errUnknownPreset   = errors.New("unknown preset")
+	errNoCopies        = errors.New("no copies to make")
+)
+
+// uploadCopies returns the copies to make of the upload req: either the copies
+// given or those of the preset named.
+func (c *Config) uploadCopies(req *uploadRequest) ([]SaveImageArg, error) {
+	switch {
+	case req.Copies != nil && req.Preset != "":
+		return nil, errCopiesAndPreset
+	case req.Preset != "":
+		p, ok := c.Presets[req.Preset]
+		if !ok {
+			return nil, errUnknownPreset
+		}
+		return append([]SaveImageArg(nil), p...), nil // SaveImage modifies args
+	case len(req.Copies) > 0:
+		return req.Copies, nil
+	}
+	return nil, errNoCopies
+}
@@ -0,0 +1,123 @@
+package citra
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime/multipart"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func multipartBody(t *testing.T, image []byte, fields map[string]string) *multipart.Reader {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := w.WriteField(name, value); err != nil {
+			t.Fatalf("WriteField: %v", err)
+		}
+	}
+	part, err := w.CreateFormFile("image", "image.jpg")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	part.Write(image)
+	w.Close()
+	return multipart.NewReader(&body, w.Boundary())
+}
+
+func TestReadMultipartUpload(t *testing.T) {
+	dir := t.TempDir()
+
+	image := bytes.Repeat([]byte("0123456789"), 1000)
+	mr := multipartBody(t, image, map[string]string{"preset": "avatar", "async": "true"})
+	upload, form, err := readMultipartUpload(mr, dir, int64(len(image)))
+	if err != nil {
+		t.Fatalf("readMultipartUpload: %v", err)
+	}
+	if !bytes.Equal(upload.Bytes(), image) {
+		t.Fatalf("upload contents differ")
+	}
+	if form.Get("preset") != "avatar" || form.Get("async") != "true" {
+		t.Fatalf("want preset and async form values, got %v", form)
+	}
+	if err = upload.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("want temporary file removed, got %d files", len(files))
+	}
+
+	mr = multipartBody(t, image, nil)
+	if _, _, err = readMultipartUpload(mr, dir, int64(len(image)-1)); err != ErrUploadTooLarge {
+		t.Fatalf("want ErrUploadTooLarge, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("want temporary file removed after failure, got %d files", len(files))
+	}
+
+	mr = multipartBody(t, image, map[string]string{"copies": strings.Repeat(" ", maxFormValueSize+1)})
+	if _, _, err = readMultipartUpload(mr, dir, int64(len(image))); err != errFormValueTooLarge {
+		t.Fatalf("want errFormValueTooLarge, got %v", err)
+	}
+}
+
+func TestReadJSONUpload(t *testing.T) {
+	dir := t.TempDir()
+
+	image := bytes.Repeat([]byte("0123456789"), 1000)
+	encoded := strings.ReplaceAll(base64.StdEncoding.EncodeToString(image), "/", `\/`)
+	body := `{"preset": "avatar", "image" : "` + encoded + `", "async": true}`
+	upload, req, err := readJSONUpload(strings.NewReader(body), dir, int64(len(image)))
+	if err != nil {
+		t.Fatalf("readJSONUpload: %v", err)
+	}
+	if !bytes.Equal(upload.Bytes(), image) || !bytes.Equal(req.Image, image) {
+		t.Fatalf("upload contents differ")
+	}
+	if req.Preset != "avatar" || !req.Async {
+		t.Fatalf("want preset and async, got %+v", req)
+	}
+	if err = upload.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, _, err = readJSONUpload(strings.NewReader(body), dir, int64(len(image)-1)); err != ErrUploadTooLarge {
+		t.Fatalf("want ErrUploadTooLarge, got %v", err)
+	}
+	// Escaped line breaks are skipped by the decoder, but count toward the
+	// limit.
+	padded := `{"image": "` + strings.Repeat(`\n`, 3*len(encoded)) + encoded + `"}`
+	if _, _, err = readJSONUpload(strings.NewReader(padded), dir, int64(len(image))); err != ErrUploadTooLarge {
+		t.Fatalf("padded with line breaks: want ErrUploadTooLarge, got %v", err)
+	}
+	for _, body := range []string{`{"image": "!!!!"}`, `{"image": 1}`, `{"image": "AAAA"`, `[]`, `{"async": "yes"}`,
+		`{"image": "AA\u0041A"}`, `{"image": "AAAA\u000a"}`, `{"image": "AAAA\t"}`} {
+		if _, _, err = readJSONUpload(strings.NewReader(body), dir, int64(len(image))); err != errInvalidUploadJSON {
+			t.Fatalf("readJSONUpload(%s): want errInvalidUploadJSON, got %v", body, err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("want temporary files removed, got %d files", len(files))
+	}
+}
+
+func TestUploadRequestFromValues(t *testing.T) {
+	v := url.Values{}
+	v.Set("copies", `[{"maxWidth": 400, "maxHeight": 400, "imageFit": "cover", "default": true}]`)
+	v.Set("async", "true")
+	req, err := uploadRequestFromValues(v)
+	if err != nil {
+		t.Fatalf("uploadRequestFromValues: %v", err)
+	}
+	if len(req.Copies) != 1 || !req.Copies[0].IsDefault || req.Copies[0].MaxWidth != 400 || !req.Async {
+		t.Fatalf("unexpected request %+v", req)
+	}
+
+	v = url.Values{}
+	v.Set("copies", "[")
+	if _, err = uploadRequestFromValues(v); err != errInvalidUploadJSON {
+		t.Fatalf("want errInvalidUploadJSON, got %v", err)
+	}
+}